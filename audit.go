@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// auditLog records every check to the audit-log, it is nil if no audit
+// log is configured
+var auditLog *auditLogger
+
+// auditEntry is a single line of the audit log
+type auditEntry struct {
+	Time         time.Time         `json:"time"`
+	VaultAddress string            `json:"vault_address"`
+	CheckMode    string            `json:"check_mode"`
+	VaultKey     string            `json:"vault_key"`
+	Outcome      string            `json:"outcome"`
+	Duration     float64           `json:"duration_seconds"`
+	Operations   []statusOperation `json:"operations"`
+	Operation    string            `json:"failed_operation,omitempty"`
+	ErrorClass   string            `json:"error_class,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// auditLogger appends JSON lines to a file. The file is reopened on SIGHUP
+// to support external rotation and rotated to a single backup with the
+// suffix .1 when it exceeds the maximum size.
+type auditLogger struct {
+	path    string
+	maxSize int64
+
+	file *os.File
+	size int64
+	lock sync.Mutex
+}
+
+// startAuditLog opens the audit-log and reopens it on every SIGHUP
+func startAuditLog() {
+	a := &auditLogger{path: cfg.AuditLog, maxSize: int64(cfg.AuditLogMaxSize) * 1024 * 1024}
+	if err := a.open(); err != nil {
+		logger.Fatalf("Unable to open audit-log: %s", err)
+	}
+	auditLog = a
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := a.Reopen(); err != nil {
+				logger.Errorf("Unable to reopen audit-log: %s", err)
+				continue
+			}
+			logger.Infof("Reopened audit-log")
+		}
+	}()
+}
+
+func (a *auditLogger) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	a.file = f
+	a.size = stat.Size()
+	return nil
+}
+
+// Reopen closes the file and opens the file at the path again
+func (a *auditLogger) Reopen() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.file.Close()
+	return a.open()
+}
+
+// Record appends the result of a check to the audit log
+func (a *auditLogger) Record(t *checkTarget, start time.Time, duration time.Duration, result checkResult, err error) {
+	entry := auditEntry{
+		Time:         start,
+		VaultAddress: t.address,
+		CheckMode:    t.mode,
+		VaultKey:     t.key,
+		Outcome:      "success",
+		Duration:     duration.Seconds(),
+		Operations:   []statusOperation{},
+	}
+	for _, o := range result {
+		entry.Operations = append(entry.Operations, statusOperation{o.Operation, o.Duration.Seconds()})
+	}
+	if err != nil {
+		entry.Outcome = "failure"
+		entry.Operation = failedOperation(err)
+		entry.ErrorClass = classifyError(err)
+		entry.Error = err.Error()
+	}
+
+	line, mErr := json.Marshal(entry)
+	if mErr != nil {
+		logger.Errorf("Unable to encode audit-log entry: %s", mErr)
+		return
+	}
+
+	if wErr := a.write(append(line, '\n')); wErr != nil {
+		logger.Errorf("Unable to write audit-log: %s", wErr)
+	}
+}
+
+func (a *auditLogger) write(line []byte) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("Unable to rotate: %s", err)
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate moves the current file to the backup, replacing the previous
+// backup, and starts a new file
+func (a *auditLogger) rotate() error {
+	a.file.Close()
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		// Keep writing to the current file instead of losing entries
+		if oErr := a.open(); oErr != nil {
+			return oErr
+		}
+		return err
+	}
+	return a.open()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+)
+
+// requiredCapabilities returns the capabilities the token needs on each
+// path to execute the check of the given mode against the key
+func requiredCapabilities(mode, key string) map[string][]string {
+	switch mode {
+	case checkModeTransit:
+		return map[string][]string{
+			transitPath(key, "encrypt"): {"update"},
+			transitPath(key, "decrypt"): {"update"},
+		}
+	case checkModeDatabase:
+		return map[string][]string{databaseCredsPath(key): {"read"}}
+	case checkModeWrapping:
+		return map[string][]string{wrappingKey: {"update"}}
+	case checkModeReplication:
+		// The key is left in place and overwritten by the next check
+		return map[string][]string{kvPath(key, "data"): {"create", "update"}}
+	}
+
+	// Deletes remove the key through its metadata path which for KV v1 is
+	// the same as the data path
+	ops := kvOperations()
+	caps := map[string][]string{}
+	dataPath, metadataPath := kvPath(key, "data"), kvPath(key, "metadata")
+	if stringInSlice("write", ops) {
+		caps[dataPath] = append(caps[dataPath], "create")
+		if !stringInSlice("delete", ops) {
+			// The key is left in place and overwritten by the next check
+			caps[dataPath] = append(caps[dataPath], "update")
+		}
+	}
+	if stringInSlice("read", ops) {
+		caps[dataPath] = append(caps[dataPath], "read")
+	}
+	if stringInSlice("delete", ops) {
+		caps[metadataPath] = append(caps[metadataPath], "delete")
+	}
+	return caps
+}
+
+// checkCapabilities verifies the token has the capabilities required by
+// the check on every target to report an under-privileged token at
+// startup instead of failing checks with permission errors
+func checkCapabilities() {
+	for _, t := range targets {
+		client, err := getVaultClient(t.address)
+		if err != nil {
+			logger.Warnf("Could not verify token capabilities for %s: %s", t.name(), err)
+			continue
+		}
+
+		for path, required := range requiredCapabilities(t.mode, t.key) {
+			granted, err := client.Sys().CapabilitiesSelf(path)
+			if err != nil {
+				logger.Warnf("Could not verify token capabilities on %s: %s", path, err)
+				continue
+			}
+
+			if missing := missingCapabilities(required, granted); len(missing) > 0 {
+				logger.WithFields(t.logFields()).WithFields(logFields{
+					"path":    path,
+					"granted": strings.Join(granted, ","),
+				}).Errorf("Token is missing the capabilities %s on %s, the checks of %s will fail", strings.Join(missing, ", "), path, t.name())
+				continue
+			}
+
+			logger.Debugf("Token has the required capabilities on %s", path)
+		}
+	}
+}
+
+// missingCapabilities returns the required capabilities not granted, the
+// root capability grants all of them
+func missingCapabilities(required, granted []string) []string {
+	if stringInSlice("root", granted) {
+		return nil
+	}
+
+	var missing []string
+	for _, c := range required {
+		if !stringInSlice(c, granted) {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRequiredCapabilitiesKV(t *testing.T) {
+	defer func(ops []string, version, iterations int) {
+		cfg.Operations, cfg.KVVersion, cfg.WriteIterations = ops, version, iterations
+	}(cfg.Operations, cfg.KVVersion, cfg.WriteIterations)
+	cfg.WriteIterations = 1
+
+	for _, tc := range []struct {
+		version int
+		ops     []string
+		want    map[string][]string
+	}{
+		{1, []string{"write", "read", "delete"}, map[string][]string{
+			"secret/test": {"create", "read", "delete"},
+		}},
+		{2, []string{"write", "read", "delete"}, map[string][]string{
+			"secret/data/test":     {"create", "read"},
+			"secret/metadata/test": {"delete"},
+		}},
+		{2, []string{"write", "read"}, map[string][]string{
+			"secret/data/test": {"create", "update", "read"},
+		}},
+	} {
+		cfg.KVVersion, cfg.Operations = tc.version, tc.ops
+		if got := requiredCapabilities(checkModeKV, "/secret/test"); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("kv-version %d with %v: got %v, want %v", tc.version, tc.ops, got, tc.want)
+		}
+	}
+}
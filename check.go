@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	uuid "github.com/satori/go.uuid"
+)
+
+// operationDuration is the time a single operation of a check took
+type operationDuration struct {
+	Operation string
+	Duration  time.Duration
+}
+
+// checkResult contains the durations of the operations of a check in the
+// order they were executed. Operations not executed due to an earlier
+// failure are not contained.
+type checkResult []operationDuration
+
+func (c *checkResult) record(op string, start time.Time) {
+	*c = append(*c, operationDuration{op, time.Since(start)})
+}
+
+// Slowest returns the name and duration of the slowest operation
+func (c checkResult) Slowest() (string, time.Duration) {
+	var (
+		op string
+		d  time.Duration
+	)
+	for _, o := range c {
+		if o.Duration > d || op == "" {
+			op, d = o.Operation, o.Duration
+		}
+	}
+	return op, d
+}
+
+// String lists the operations with their durations
+func (c checkResult) String() string {
+	parts := make([]string, len(c))
+	for i, o := range c {
+		parts[i] = fmt.Sprintf("%s: %s", o.Operation, o.Duration)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// logFields returns the durations to be attached to a log line
+func (c checkResult) logFields() logFields {
+	f := logFields{}
+	for _, o := range c {
+		f[o.Operation+"_duration"] = o.Duration.String()
+	}
+	return f
+}
+
+// checkError annotates an error with the operation of the check it
+// occurred in
+type checkError struct {
+	Operation string
+	Err       error
+}
+
+func (c checkError) Error() string { return c.Err.Error() }
+func (c checkError) Unwrap() error { return c.Err }
+
+// failedOperation returns the operation the error occurred in or an empty
+// string if it did not occur during an operation
+func failedOperation(err error) string {
+	var cErr checkError
+	if errors.As(err, &cErr) {
+		return cErr.Operation
+	}
+	return ""
+}
+
+// dataError marks a check having failed because Vault returned unexpected
+// data instead of an error
+type dataError string
+
+func (d dataError) Error() string { return string(d) }
+
+const (
+	errorClassAuth       = "auth"
+	errorClassConnection = "connection"
+	errorClassData       = "data"
+	errorClassServer     = "server"
+	errorClassRequest    = "request"
+	errorClassUnknown    = "unknown"
+)
+
+var errorClasses = []string{errorClassAuth, errorClassConnection, errorClassData, errorClassServer, errorClassRequest, errorClassUnknown}
+
+// classifyError sorts the error of a check into a category to tell
+// policy or token issues apart from an unavailable Vault or inconsistent
+// data. It returns an empty string for nil errors.
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var dErr dataError
+	if errors.As(err, &dErr) {
+		return errorClassData
+	}
+
+	if isConnectionError(err) {
+		return errorClassConnection
+	}
+
+	switch code := vaultStatusCode(err); {
+	case code == 401 || code == 403:
+		return errorClassAuth
+	case code >= 500:
+		return errorClassServer
+	case code >= 400:
+		return errorClassRequest
+	}
+
+	return errorClassUnknown
+}
+
+// runCheck executes the test for the target using the shared Vault client
+// of its node and drops the client after connection-level errors to have
+// it recreated on the next run. While the circuit breaker is open only the
+// seal status is probed and the full test resumes once it is reachable.
+func runCheck(ctx context.Context, t *checkTarget) (checkResult, error) {
+	// Requests still in flight when the check returns are cancelled
+	var cancel context.CancelFunc
+	if cfg.CheckTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.CheckTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	client, err := getVaultClient(t.address)
+	if err != nil {
+		return checkResult{}, err
+	}
+
+	t.trace = nil
+	if cfg.RequestIDHeader != "" {
+		t.trace = newRequestTrace()
+	}
+	if client, err = checkClient(ctx, t.address, client, t.trace); err != nil {
+		return checkResult{}, err
+	}
+
+	if t.circuitOpen() {
+		if result, err := probeConnectivity(client); err != nil {
+			resetVaultClient(t.address)
+			return result, err
+		}
+		logger.WithFields(t.logFields()).Infof("Vault is reachable again, closing circuit breaker")
+		t.connectionFailures = 0
+	}
+
+	result, err := executeTest(ctx, client, t)
+	if isConnectionError(err) {
+		resetVaultClient(t.address)
+		t.connectionFailures++
+		if t.circuitOpen() {
+			logger.WithFields(t.logFields()).Warnf("Opening circuit breaker after %d connection failures, probing the seal status only", t.connectionFailures)
+		}
+	} else if ctx.Err() == nil {
+		t.connectionFailures = 0
+	}
+
+	return result, err
+}
+
+// probeConnectivity reads the seal status as a cheap request not requiring
+// a token to find out whether Vault is reachable
+func probeConnectivity(client *api.Client) (checkResult, error) {
+	var result checkResult
+
+	start := time.Now()
+	_, err := client.Sys().SealStatus()
+	result.record("seal_status", start)
+	if err != nil {
+		return result, checkError{"seal_status", fmt.Errorf("Vault is still unreachable: %w", err)}
+	}
+	return result, nil
+}
+
+// executeTest runs the check of the mode of the target against its key.
+// The check is aborted when the context is done.
+func executeTest(ctx context.Context, client *api.Client, t *checkTarget) (checkResult, error) {
+	switch t.mode {
+	case checkModeTransit:
+		return executeTransitTest(ctx, client, t.key)
+	case checkModeDatabase:
+		return executeDatabaseTest(ctx, client, t)
+	case checkModeWrapping:
+		return executeWrappingTest(ctx, client)
+	case checkModeReplication:
+		return executeReplicationTest(ctx, client, t.trace, t.key)
+	}
+	return executeKVTest(ctx, client, t.key)
+}
+
+// executeKVTest executes the configured operations in order: writes store
+// random values, reads verify the values of the last write or, after a
+// delete, that the key is gone and deletes remove the key. By default the
+// sequence is write, read and delete.
+func executeKVTest(ctx context.Context, client *api.Client, key string) (checkResult, error) {
+	var (
+		result checkResult
+		// expectedValues holds the values (or with payload-size their
+		// checksums) of the last write and is nil before the first write
+		expectedValues map[string]string
+		deleted        bool
+	)
+
+	for _, op := range kvOperations() {
+		var err error
+		switch op {
+		case "write":
+			expectedValues, err = kvWrite(ctx, client, key, &result)
+			deleted = false
+		case "read":
+			err = kvRead(ctx, client, key, expectedValues, deleted, &result)
+		case "delete":
+			err = kvDelete(ctx, client, key, &result)
+			deleted = true
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// kvOperations returns the sequence of operations of the kv check. Every
+// write is repeated write-iterations times, with skip-delete the deletes
+// are dropped and confirm-delete-propagation adds a read if the last
+// operation is a delete.
+func kvOperations() []string {
+	var ops []string
+	for _, op := range nonEmpty(cfg.Operations) {
+		switch {
+		case op == "delete" && cfg.SkipDelete:
+			continue
+		case op == "write":
+			for i := 0; i < cfg.WriteIterations; i++ {
+				ops = append(ops, op)
+			}
+		default:
+			ops = append(ops, op)
+		}
+	}
+
+	if cfg.ConfirmDelete && len(ops) > 0 && ops[len(ops)-1] == "delete" {
+		ops = append(ops, "read")
+	}
+
+	return ops
+}
+
+// deletesTestKey reports whether the check of the given mode deletes the
+// test key and therefore leftovers of the check are to be cleaned up
+func deletesTestKey(mode string) bool {
+	return mode == checkModeKV && stringInSlice("delete", kvOperations())
+}
+
+func kvWrite(ctx context.Context, client *api.Client, key string, result *checkResult) (map[string]string, error) {
+	values := map[string]interface{}{}
+	expected := map[string]string{}
+	for _, field := range testFieldNames() {
+		value, expectation, err := testValue()
+		if err != nil {
+			return nil, checkError{"write", err}
+		}
+		values[field] = value
+		expected[field] = expectation
+	}
+
+	start := time.Now()
+	_, err := withRetries(ctx, func() (*api.Secret, error) {
+		return client.Logical().Write(kvPath(key, "data"), kvPayload(values))
+	})
+	result.record("write", start)
+	if err != nil {
+		return nil, checkError{"write", fmt.Errorf("Could not write key: %w", err)}
+	}
+
+	return expected, nil
+}
+
+// testValue generates the value to write and the expectation to verify
+// it against: a UUID (or the fixed-value) compared as is or, with
+// payload-size, that many random bytes encoded as base64 and verified by
+// their SHA-256 checksum
+func testValue() (string, string, error) {
+	if cfg.PayloadSize == 0 {
+		v := plainTestValue()
+		return v, v, nil
+	}
+
+	payload := make([]byte, cfg.PayloadSize)
+	if _, err := rand.Read(payload); err != nil {
+		return "", "", fmt.Errorf("Could not generate payload: %s", err)
+	}
+
+	sum := sha256.Sum256(payload)
+	return base64.StdEncoding.EncodeToString(payload), hex.EncodeToString(sum[:]), nil
+}
+
+// plainTestValue returns the fixed-value if set and a fresh UUID otherwise
+func plainTestValue() string {
+	if cfg.FixedValue != "" {
+		return cfg.FixedValue
+	}
+	return uuid.NewV4().String()
+}
+
+// matchesTestValue verifies a read value against the expectation
+// generated by testValue
+func matchesTestValue(value, expectation string) bool {
+	if cfg.PayloadSize == 0 {
+		return value == expectation
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return false
+	}
+
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:]) == expectation
+}
+
+// kvRead reads the key and verifies the expected values. Reads after a
+// delete are recorded as confirm_delete and fail if the key is still
+// readable, reads before the first write only verify the key is readable.
+// Mismatching data is read again up to read-retries times to tolerate
+// eventually consistent storage backends.
+func kvRead(ctx context.Context, client *api.Client, key string, expectedValues map[string]string, deleted bool, result *checkResult) error {
+	op := "read"
+	if deleted {
+		op = "confirm_delete"
+	}
+
+	start := time.Now()
+	defer func() { result.record(op, start) }()
+
+	for attempt := 0; ; attempt++ {
+		data, err := withRetries(ctx, func() (*api.Secret, error) {
+			return client.Logical().Read(kvPath(key, "data"))
+		})
+
+		switch {
+		case err != nil && deleted:
+			return checkError{op, fmt.Errorf("Could not read key after delete: %w", err)}
+		case err != nil:
+			return checkError{op, fmt.Errorf("Could not read key: %w", err)}
+		}
+
+		dErr := verifyKVData(data, expectedValues, deleted)
+		if dErr == nil {
+			return nil
+		}
+
+		if attempt >= cfg.ReadRetries {
+			return checkError{op, dErr}
+		}
+
+		logger.Debugf("Read data did not match (attempt %d/%d): %s", attempt+1, cfg.ReadRetries+1, dErr)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(cfg.ReadRetryDelay):
+		}
+	}
+}
+
+// verifyKVData checks the read data contains the expected values or, after
+// a delete, the key is gone
+func verifyKVData(data *api.Secret, expectedValues map[string]string, deleted bool) error {
+	values := kvValues(data)
+
+	if deleted {
+		if _, ok := values[cfg.TestField]; ok {
+			return dataError("Key is still readable after delete.")
+		}
+		return nil
+	}
+
+	if expectedValues == nil {
+		return nil
+	}
+
+	for _, field := range testFieldNames() {
+		if v, ok := values[field].(string); !ok || !matchesTestValue(v, expectedValues[field]) {
+			return dataError(fmt.Sprintf("Did not find expected value of field %s in key.", field))
+		}
+	}
+
+	return nil
+}
+
+func kvDelete(ctx context.Context, client *api.Client, key string, result *checkResult) error {
+	start := time.Now()
+	_, err := withRetries(ctx, func() (*api.Secret, error) {
+		return client.Logical().Delete(kvPath(key, "metadata"))
+	})
+	result.record("delete", start)
+	if err != nil {
+		return checkError{"delete", fmt.Errorf("Could not delete key: %w", err)}
+	}
+	return nil
+}
+
+// testFieldNames returns the names of the fields written by the check, the
+// first one is the test-field itself
+func testFieldNames() []string {
+	names := []string{cfg.TestField}
+	for i := 2; i <= cfg.TestFields; i++ {
+		names = append(names, fmt.Sprintf("%s_%d", cfg.TestField, i))
+	}
+	return names
+}
+
+// cleanupTestKey deletes the test key if it exists and reports whether
+// there was something to delete
+func cleanupTestKey(client *api.Client, key string) (bool, error) {
+	data, err := client.Logical().Read(kvPath(key, "data"))
+	if err != nil {
+		return false, err
+	}
+
+	if len(kvValues(data)) == 0 {
+		return false, nil
+	}
+
+	if _, err := client.Logical().Delete(kvPath(key, "metadata")); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// vaultOperation is a single request against the Vault API
+type vaultOperation func() (*api.Secret, error)
+
+// withRetries executes the operation, retrying it up to operation-retries
+// times if it fails. Every attempt is bounded by operation-timeout and no
+// further attempts are made once the context is done.
+func withRetries(ctx context.Context, op vaultOperation) (*api.Secret, error) {
+	var (
+		secret *api.Secret
+		err    error
+	)
+
+	for attempt := 0; attempt <= cfg.OperationRetries; attempt++ {
+		opCtx, cancel := context.WithTimeout(ctx, cfg.OperationTimeout)
+		secret, err = runWithContext(opCtx, op)
+		cancel()
+
+		if err == nil {
+			return secret, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if attempt < cfg.OperationRetries {
+			logger.Debugf("Operation failed (attempt %d/%d): %s", attempt+1, cfg.OperationRetries+1, err)
+		}
+	}
+
+	return nil, err
+}
+
+// inflightOps tracks the operations still running after runWithContext
+// returned early to not clean up test keys before they are finished
+var inflightOps sync.WaitGroup
+
+// runWithContext executes the operation and returns early when the context
+// is done. The vendored Vault client does not accept a context therefore
+// the requests of a check are cancelled through the transport of its
+// client (see checkClient) and all others are bounded by the timeout of
+// their HTTP client.
+func runWithContext(ctx context.Context, op vaultOperation) (*api.Secret, error) {
+	type opResult struct {
+		secret *api.Secret
+		err    error
+	}
+
+	resC := make(chan opResult, 1)
+	inflightOps.Add(1)
+	go func() {
+		defer inflightOps.Done()
+		secret, err := op()
+		resC <- opResult{secret, err}
+	}()
+
+	select {
+	case res := <-resC:
+		return res.secret, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// kvPath returns the API path for the given key. For KV v2 mounts the first
+// path segment is treated as the mount and the given prefix (`data` or
+// `metadata`) is inserted after it.
+func kvPath(key, v2Prefix string) string {
+	key = strings.TrimLeft(key, "/")
+	if cfg.KVVersion != 2 {
+		return key
+	}
+
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) < 2 {
+		return strings.Join([]string{key, v2Prefix}, "/")
+	}
+	return strings.Join([]string{parts[0], v2Prefix, parts[1]}, "/")
+}
+
+// kvPayload wraps the data to write into the format required by the
+// configured KV version
+func kvPayload(data map[string]interface{}) map[string]interface{} {
+	if cfg.KVVersion != 2 {
+		return data
+	}
+	return map[string]interface{}{"data": data}
+}
+
+// kvValues extracts the stored values from a read response, unwrapping
+// the nested data of KV v2 responses
+func kvValues(secret *api.Secret) map[string]interface{} {
+	if secret == nil || secret.Data == nil {
+		return nil
+	}
+
+	if cfg.KVVersion != 2 {
+		return secret.Data
+	}
+
+	values, _ := secret.Data["data"].(map[string]interface{})
+	return values
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// executeDatabaseTest requests a dynamic credential of the database role
+// given as key of the target, verifies the response contains username and
+// password and revokes the lease of the credential afterwards
+func executeDatabaseTest(ctx context.Context, client *api.Client, t *checkTarget) (checkResult, error) {
+	var (
+		result checkResult
+		start  time.Time
+	)
+
+	start = time.Now()
+	creds, err := withRetries(ctx, func() (*api.Secret, error) {
+		return client.Logical().Read(databaseCredsPath(t.key))
+	})
+	result.record("creds", start)
+	if err != nil {
+		return result, checkError{"creds", fmt.Errorf("Could not request credential: %w", err)}
+	}
+
+	if creds == nil {
+		return result, checkError{"creds", dataError("Did not receive a credential.")}
+	}
+
+	_, hasUser := secretString(creds, "username")
+	_, hasPassword := secretString(creds, "password")
+	if !hasUser || !hasPassword {
+		err := checkError{"creds", dataError("Did not find username and password in credential.")}
+		if creds.LeaseID != "" {
+			// Do not leave the incomplete credential behind
+			if _, rErr := withRetries(ctx, func() (*api.Secret, error) {
+				return nil, client.Sys().Revoke(creds.LeaseID)
+			}); rErr != nil {
+				logger.WithFields(t.logFields()).Errorf("Could not revoke lease %s of incomplete credential: %s", creds.LeaseID, rErr)
+			}
+		}
+		return result, err
+	}
+
+	if creds.LeaseID == "" {
+		return result, checkError{"creds", dataError("Credential has no lease to revoke.")}
+	}
+
+	start = time.Now()
+	_, err = withRetries(ctx, func() (*api.Secret, error) {
+		return nil, client.Sys().Revoke(creds.LeaseID)
+	})
+	result.record("revoke", start)
+	if err != nil {
+		return result, checkError{"revoke", fmt.Errorf("Could not revoke credential lease: %w", err)}
+	}
+
+	return result, nil
+}
+
+// databaseCredsPath returns the API path of the credentials of a role
+// given in format mount/role
+func databaseCredsPath(role string) string {
+	parts := strings.SplitN(strings.Trim(role, "/"), "/", 2)
+	if len(parts) < 2 {
+		return "database/creds/" + parts[0]
+	}
+	return parts[0] + "/creds/" + parts[1]
+}
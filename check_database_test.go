@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDatabaseIncompleteCredentialRevoked verifies the lease of a
+// credential without password is revoked with retries
+func TestDatabaseIncompleteCredentialRevoked(t *testing.T) {
+	var revokes int32
+	vault := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/sys/revoke/") {
+			atomic.AddInt32(&revokes, 1)
+			http.Error(res, `{"errors":["revoke failed"]}`, http.StatusInternalServerError)
+			return
+		}
+		res.Write([]byte(`{"lease_id":"database/creds/test/1","data":{"username":"user"}}`))
+	}))
+	defer vault.Close()
+	defer resetVaultClient(vault.URL)
+
+	defer func(token string, retries int, timeout time.Duration) {
+		cfg.VaultToken, cfg.OperationRetries, cfg.OperationTimeout = token, retries, timeout
+	}(cfg.VaultToken, cfg.OperationRetries, cfg.OperationTimeout)
+	cfg.VaultToken = "test"
+	cfg.OperationRetries = 1
+	cfg.OperationTimeout = 5 * time.Second
+
+	client, err := getVaultClient(vault.URL)
+	if err != nil {
+		t.Fatalf("creating client: %s", err)
+	}
+
+	target := newCheckTarget(vault.URL, checkModeDatabase, "database/test")
+	if _, err := executeDatabaseTest(context.Background(), client, target); err == nil {
+		t.Fatal("check of a credential without password succeeded")
+	}
+
+	if n := atomic.LoadInt32(&revokes); n != 2 {
+		t.Errorf("lease of the incomplete credential was revoked %d times, want 2 attempts", n)
+	}
+}
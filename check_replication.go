@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// replicationPollInterval is the delay between the reads of the secondary
+// while waiting for the write to arrive
+const replicationPollInterval = 100 * time.Millisecond
+
+// executeReplicationTest writes a random value to the key on the primary
+// and reads the key from the replication-secondary until the value
+// arrived. The time until then is recorded as the replication operation
+// and the check fails if it exceeds replication-max-lag. The requests to
+// the secondary are cancelled with the check and sent with IDs of the
+// trace like the ones to the primary.
+func executeReplicationTest(ctx context.Context, client *api.Client, trace *requestTrace, key string) (checkResult, error) {
+	var (
+		result checkResult
+		start  time.Time
+	)
+
+	expectedValue := plainTestValue()
+
+	start = time.Now()
+	_, err := withRetries(ctx, func() (*api.Secret, error) {
+		return client.Logical().Write(kvPath(key, "data"), kvPayload(map[string]interface{}{cfg.TestField: expectedValue}))
+	})
+	result.record("write", start)
+	if err != nil {
+		return result, checkError{"write", fmt.Errorf("Could not write key: %w", err)}
+	}
+
+	// Errors of the secondary are not wrapped to not count them as
+	// connection errors of the primary resetting its client and opening
+	// its circuit breaker
+	secondary, err := getVaultClient(cfg.ReplicationSecondary)
+	if err == nil {
+		secondary, err = checkClient(ctx, cfg.ReplicationSecondary, secondary, trace)
+	}
+	if err != nil {
+		return result, checkError{"replication", fmt.Errorf("Could not create client for secondary: %s", err)}
+	}
+
+	start = time.Now()
+	finish := func(err error) (checkResult, error) {
+		result.record("replication", start)
+		return result, err
+	}
+
+	for {
+		data, err := withRetries(ctx, func() (*api.Secret, error) {
+			return secondary.Logical().Read(kvPath(key, "data"))
+		})
+		if err != nil {
+			if isConnectionError(err) {
+				resetVaultClient(cfg.ReplicationSecondary)
+			}
+			return finish(checkError{"replication", fmt.Errorf("Could not read key from secondary: %s", err)})
+		}
+
+		if value, _ := kvValues(data)[cfg.TestField].(string); value == expectedValue {
+			return finish(nil)
+		}
+
+		if time.Since(start) >= cfg.ReplicationMaxLag {
+			return finish(checkError{"replication", dataError(fmt.Sprintf("Write did not arrive on the secondary within %s.", cfg.ReplicationMaxLag))})
+		}
+
+		select {
+		case <-ctx.Done():
+			return finish(ctx.Err())
+		case <-time.After(replicationPollInterval):
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReplicationSecondaryUnreachable verifies an unreachable secondary is
+// not reported as a connection error of the primary
+func TestReplicationSecondaryUnreachable(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	defer primary.Close()
+
+	defer func(secondary, token string, timeout time.Duration) {
+		cfg.ReplicationSecondary, cfg.VaultToken, cfg.OperationTimeout = secondary, token, timeout
+	}(cfg.ReplicationSecondary, cfg.VaultToken, cfg.OperationTimeout)
+	cfg.ReplicationSecondary = "http://127.0.0.1:1"
+	cfg.VaultToken = "test"
+	cfg.OperationTimeout = 5 * time.Second
+
+	client, err := getVaultClient(primary.URL)
+	if err != nil {
+		t.Fatalf("creating client: %s", err)
+	}
+
+	_, err = executeReplicationTest(context.Background(), client, nil, "secret/test")
+	switch {
+	case err == nil:
+		t.Fatal("check against an unreachable secondary succeeded")
+	case failedOperation(err) != "replication":
+		t.Errorf("failed operation is %q, want replication: %s", failedOperation(err), err)
+	case isConnectionError(err):
+		t.Errorf("error of the secondary is a connection error of the primary: %s", err)
+	}
+}
+
+// TestReplicationSecondaryCancelled verifies the reads of the secondary
+// carry the request ID and are cancelled together with the check
+func TestReplicationSecondaryCancelled(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	defer primary.Close()
+
+	requestIDs := make(chan string, 1)
+	secondary := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		select {
+		case requestIDs <- r.Header.Get("X-Request-Id"):
+		default:
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer secondary.Close()
+	defer resetVaultClient(secondary.URL)
+	defer resetVaultClient(primary.URL)
+
+	defer func(secondary, token, header string, timeout time.Duration) {
+		cfg.ReplicationSecondary, cfg.VaultToken, cfg.RequestIDHeader, cfg.OperationTimeout = secondary, token, header, timeout
+	}(cfg.ReplicationSecondary, cfg.VaultToken, cfg.RequestIDHeader, cfg.OperationTimeout)
+	cfg.ReplicationSecondary = secondary.URL
+	cfg.VaultToken = "test"
+	cfg.RequestIDHeader = "X-Request-Id"
+	cfg.OperationTimeout = 10 * time.Second
+
+	client, err := getVaultClient(primary.URL)
+	if err != nil {
+		t.Fatalf("creating client: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	trace := newRequestTrace()
+	start := time.Now()
+	if _, err = executeReplicationTest(ctx, client, trace, "secret/test"); err == nil {
+		t.Fatal("check against a hanging secondary succeeded")
+	}
+
+	// The abandoned read has to return once its request is cancelled
+	inflightOps.Wait()
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("read of the secondary was not cancelled with the check, took %s", d)
+	}
+
+	select {
+	case id := <-requestIDs:
+		if !strings.HasPrefix(id, trace.checkID+"-") {
+			t.Errorf("secondary received request ID %q, want one of check %s", id, trace.checkID)
+		}
+	default:
+		t.Error("secondary received no request")
+	}
+}
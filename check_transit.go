@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	checkModeKV      = "kv"
+	checkModeTransit = "transit"
+	// checkModeDatabase is implemented in check_database.go
+	checkModeDatabase = "database"
+	// checkModeWrapping is implemented in check_wrapping.go
+	checkModeWrapping = "wrapping"
+	// checkModeReplication is implemented in check_replication.go
+	checkModeReplication = "replication"
+)
+
+// executeTransitTest encrypts a random plaintext with the transit key,
+// decrypts the ciphertext again and compares the result
+func executeTransitTest(ctx context.Context, client *api.Client, key string) (checkResult, error) {
+	var (
+		result checkResult
+		start  time.Time
+	)
+
+	expectedValue := plainTestValue()
+
+	start = time.Now()
+	data, err := withRetries(ctx, func() (*api.Secret, error) {
+		return client.Logical().Write(transitPath(key, "encrypt"), map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString([]byte(expectedValue)),
+		})
+	})
+	result.record("encrypt", start)
+	if err != nil {
+		return result, checkError{"encrypt", fmt.Errorf("Could not encrypt plaintext: %w", err)}
+	}
+
+	ciphertext, ok := secretString(data, "ciphertext")
+	if !ok {
+		return result, checkError{"encrypt", dataError("Did not find ciphertext in response.")}
+	}
+
+	start = time.Now()
+	data, err = withRetries(ctx, func() (*api.Secret, error) {
+		return client.Logical().Write(transitPath(key, "decrypt"), map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+	})
+	result.record("decrypt", start)
+	if err != nil {
+		return result, checkError{"decrypt", fmt.Errorf("Could not decrypt ciphertext: %w", err)}
+	}
+
+	encoded, _ := secretString(data, "plaintext")
+	plaintext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || string(plaintext) != expectedValue {
+		return result, checkError{"decrypt", dataError("Decrypted plaintext did not match.")}
+	}
+
+	return result, nil
+}
+
+// transitPath returns the API path of the action for a key given in
+// format mount/name
+func transitPath(key, action string) string {
+	parts := strings.SplitN(strings.Trim(key, "/"), "/", 2)
+	if len(parts) < 2 {
+		return strings.Join([]string{"transit", action, parts[0]}, "/")
+	}
+	return strings.Join([]string{parts[0], action, parts[1]}, "/")
+}
+
+func secretString(secret *api.Secret, field string) (string, bool) {
+	if secret == nil || secret.Data == nil {
+		return "", false
+	}
+	v, ok := secret.Data[field].(string)
+	return v, ok && v != ""
+}
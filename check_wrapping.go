@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// wrappingKey is the only key of the wrapping check as it does not store
+// data at a configurable path
+const wrappingKey = "sys/wrapping/wrap"
+
+// executeWrappingTest wraps a random value with the wrap-ttl, unwraps the
+// wrapping token again and compares the result
+func executeWrappingTest(ctx context.Context, client *api.Client) (checkResult, error) {
+	var (
+		result checkResult
+		start  time.Time
+	)
+
+	expectedValue := plainTestValue()
+
+	start = time.Now()
+	wrapped, err := withRetries(ctx, func() (*api.Secret, error) {
+		r := client.NewRequest("POST", "/v1/"+wrappingKey)
+		r.WrapTTL = cfg.WrapTTL.String()
+		if err := r.SetJSONBody(map[string]interface{}{cfg.TestField: expectedValue}); err != nil {
+			return nil, err
+		}
+
+		resp, err := client.RawRequest(r)
+		if resp != nil {
+			defer resp.Body.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return api.ParseSecret(resp.Body)
+	})
+	result.record("wrap", start)
+	if err != nil {
+		return result, checkError{"wrap", fmt.Errorf("Could not wrap value: %w", err)}
+	}
+
+	if wrapped == nil || wrapped.WrapInfo == nil || wrapped.WrapInfo.Token == "" {
+		return result, checkError{"wrap", dataError("Did not receive a wrapping token.")}
+	}
+
+	start = time.Now()
+	data, err := withRetries(ctx, func() (*api.Secret, error) {
+		return client.Logical().Unwrap(wrapped.WrapInfo.Token)
+	})
+	result.record("unwrap", start)
+	if err != nil {
+		return result, checkError{"unwrap", fmt.Errorf("Could not unwrap token: %w", err)}
+	}
+
+	if value, _ := secretString(data, cfg.TestField); value != expectedValue {
+		return result, checkError{"unwrap", dataError("Unwrapped value did not match.")}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/Luzifer/rconfig"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configDefaults holds the variable defaults passed to rconfig, they are
+// read from the config file and Consul
+var configDefaults = map[string]string{}
+
+// loadConfigFile reads the file given through the config flag or the
+// CONFIG environment variable and passes its values to rconfig as variable
+// defaults. Therefore values from the file are overridden by environment
+// variables and flags. As YAML is a superset of JSON both formats are
+// supported. Keys are the names of the flags, lists may be given as YAML
+// lists or comma separated strings.
+func loadConfigFile() error {
+	filename := configFileFromArgs(os.Args[1:])
+	if filename == "" {
+		filename = os.Getenv("CONFIG")
+	}
+	if filename == "" {
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(raw, &values); err != nil {
+		return fmt.Errorf("Unable to parse %s: %s", filename, err)
+	}
+
+	known := configFileKeys()
+	defaults := configDefaults
+	for k, v := range values {
+		if !known[k] {
+			return fmt.Errorf("Unknown option %q in %s", k, filename)
+		}
+
+		switch v := v.(type) {
+		case []interface{}:
+			parts := make([]string, len(v))
+			for i, p := range v {
+				parts[i] = fmt.Sprint(p)
+			}
+			defaults[k] = strings.Join(parts, ",")
+		case nil:
+			defaults[k] = ""
+		default:
+			defaults[k] = fmt.Sprint(v)
+		}
+	}
+
+	rconfig.SetVariableDefaults(defaults)
+	return nil
+}
+
+// configFileFromArgs extracts the value of the config flag from the
+// arguments as the file needs to be read before parsing the flags
+func configFileFromArgs(args []string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			return ""
+		case arg == "--config" && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(arg, "--config="):
+			return strings.TrimPrefix(arg, "--config=")
+		}
+	}
+	return ""
+}
+
+// configFileKeys returns the options which can be set through the config
+// file, these are all options having a vardefault tag
+func configFileKeys() map[string]bool {
+	keys := map[string]bool{}
+
+	t := reflect.TypeOf(cfg)
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("vardefault"); name != "" {
+			keys[name] = true
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/rconfig"
+)
+
+// consulKeys are the options read from the Consul KV store below the
+// consul-prefix, each option is stored in a key named like the flag
+var consulKeys = []string{"vault-address", "vault-key", "interval"}
+
+const consulTimeout = 10 * time.Second
+
+// loadConsulConfig reads the consulKeys from the Consul KV store and
+// parses the options again with them as variable defaults. Therefore the
+// values from Consul override the config file but are overridden by
+// environment variables and flags.
+func loadConsulConfig() error {
+	if cfg.ConsulAddr == "" {
+		return nil
+	}
+
+	client := &http.Client{Timeout: consulTimeout}
+	for _, key := range consulKeys {
+		value, found, err := readConsulKey(client, key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+
+		logger.Debugf("Read %s from Consul", key)
+		configDefaults[key] = value
+	}
+
+	rconfig.SetVariableDefaults(configDefaults)
+	return rconfig.Parse(&cfg)
+}
+
+// readConsulKey reads the raw value of the key below the consul-prefix and
+// reports whether the key exists
+func readConsulKey(client *http.Client, key string) (string, bool, error) {
+	u := strings.TrimRight(cfg.ConsulAddr, "/") + "/v1/kv/" + strings.Trim(cfg.ConsulPrefix, "/") + "/" + url.PathEscape(key) + "?raw"
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	if cfg.ConsulToken != "" {
+		req.Header.Set("X-Consul-Token", cfg.ConsulToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", false, fmt.Errorf("Could not read %s: %s", key, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", false, nil
+	case resp.StatusCode >= 400:
+		return "", false, fmt.Errorf("Could not read %s: %s", key, statusError{StatusCode: resp.StatusCode})
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, fmt.Errorf("Could not read %s: %s", key, err)
+	}
+
+	return strings.TrimSpace(string(raw)), true, nil
+}
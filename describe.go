@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+// redactedOptions contain credentials or URLs with embedded credentials
+var redactedOptions = []string{
+	"vault-token",
+	"vault-secret-id",
+	"consul-token",
+	"pagerduty-key",
+	"slack-webhook",
+	"teams-webhook",
+	"discord-webhook",
+	"opsgenie-key",
+	"smtp-pass",
+	"webhook-url",
+	"listen-auth",
+}
+
+// headerOptions contain headers in format key=value whose values are
+// redacted while the keys are kept
+var headerOptions = []string{
+	"vault-header",
+	"webhook-header",
+}
+
+// describe prints the effective configuration with redacted secrets as JSON
+// and exits
+func describe() {
+	var notifierNames []string
+	for _, n := range notifiers {
+		notifierNames = append(notifierNames, n.Name())
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(map[string]interface{}{
+		"version": version,
+		"resolved": map[string]interface{}{
+			"vault_addresses": vaultAddresses(),
+			"keys":            describeKeys(),
+			"auth_method":     vaultAuthMethod(),
+			"check_modes":     checkModes(),
+			"notifiers":       notifierNames,
+		},
+		"options": describeOptions(),
+	})
+
+	os.Exit(0)
+}
+
+// describeOptions maps the flag names to the effective values
+func describeOptions() map[string]interface{} {
+	options := map[string]interface{}{}
+
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("flag"), ",")[0]
+		if name == "" {
+			continue
+		}
+
+		var value interface{} = v.Field(i).Interface()
+		switch val := value.(type) {
+		case time.Duration:
+			value = val.String()
+		case []string:
+			value = nonEmpty(val)
+		}
+
+		switch {
+		case stringInSlice(name, redactedOptions):
+			if !v.Field(i).IsZero() {
+				value = redacted
+			}
+		case stringInSlice(name, headerOptions):
+			value = redactHeaders(nonEmpty(v.Field(i).Interface().([]string)))
+		}
+
+		options[name] = value
+	}
+
+	return options
+}
+
+func redactHeaders(headers []string) []string {
+	out := make([]string, len(headers))
+	for i, h := range headers {
+		out[i] = strings.SplitN(h, "=", 2)[0] + "=" + redacted
+	}
+	return out
+}
+
+// describeKeys maps the check modes to the keys checked in them
+func describeKeys() map[string][]string {
+	keys := map[string][]string{}
+	for _, mode := range checkModes() {
+		keys[mode] = vaultKeys(mode)
+	}
+	return keys
+}
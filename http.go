@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkStatus holds the outcome of the most recent check and is written by
+// the check loop while being read by the HTTP handlers
+type checkStatus struct {
+	lastCheck           time.Time
+	lastSuccess         time.Time
+	lastError           error
+	lastResult          checkResult
+	consecutiveFailures int
+	alertActive         alarmState
+	// history holds the most recent results, bounded by the history-size
+	history []historyEntry
+
+	lock sync.RWMutex
+}
+
+// historyEntry is the result of a single check served at /history
+type historyEntry struct {
+	Time         time.Time `json:"time"`
+	VaultAddress string    `json:"vault_address"`
+	CheckMode    string    `json:"check_mode"`
+	VaultKey     string    `json:"vault_key"`
+	Success      bool      `json:"success"`
+	Duration     float64   `json:"duration_seconds"`
+	Operation    string    `json:"failed_operation,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	LastCheck           *time.Time `json:"last_check"`
+	LastSuccess         *time.Time `json:"last_success"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	AlertActive         bool       `json:"alert_active"`
+
+	Keys map[string]healthResponse `json:"keys,omitempty"`
+}
+
+// RecordCheck stores the result of a check executed at the given time
+func (c *checkStatus) RecordCheck(t time.Time, duration time.Duration, result checkResult, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lastCheck = t
+	c.lastError = err
+	c.lastResult = result
+	if err == nil {
+		c.lastSuccess = t
+	}
+
+	if cfg.HistorySize <= 0 {
+		return
+	}
+
+	entry := historyEntry{
+		Time:     t,
+		Success:  err == nil,
+		Duration: duration.Seconds(),
+	}
+	if err != nil {
+		entry.Operation = failedOperation(err)
+		entry.Error = err.Error()
+	}
+
+	c.history = append(c.history, entry)
+	if len(c.history) > cfg.HistorySize {
+		// Copy instead of reslicing to not keep the dropped entries referenced
+		c.history = append([]historyEntry(nil), c.history[len(c.history)-cfg.HistorySize:]...)
+	}
+}
+
+// History returns a copy of the recorded results, oldest first
+func (c *checkStatus) History() []historyEntry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return append([]historyEntry(nil), c.history...)
+}
+
+// latencySummary describes the durations of the checks within a period
+type latencySummary struct {
+	P50 time.Duration
+	P95 time.Duration
+	Max time.Duration
+}
+
+// logFields returns the summary to be attached to a log line
+func (l latencySummary) logFields() logFields {
+	return logFields{
+		"latency_p50": l.P50.String(),
+		"latency_p95": l.P95.String(),
+		"latency_max": l.Max.String(),
+	}
+}
+
+// LatencySince summarizes the durations of the recorded checks executed
+// since the given time, it returns nil if no check was recorded
+func (c *checkStatus) LatencySince(since time.Time) *latencySummary {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var durations []float64
+	for _, e := range c.history {
+		if !e.Time.Before(since) {
+			durations = append(durations, e.Duration)
+		}
+	}
+	if len(durations) == 0 {
+		return nil
+	}
+
+	sort.Float64s(durations)
+	percentile := func(p float64) time.Duration {
+		// Nearest-rank method
+		i := int(math.Ceil(p*float64(len(durations)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return time.Duration(durations[i] * float64(time.Second))
+	}
+
+	return &latencySummary{
+		P50: percentile(.5),
+		P95: percentile(.95),
+		Max: percentile(1),
+	}
+}
+
+// SetAlertState stores the current failure counter and alert state
+func (c *checkStatus) SetAlertState(consecutiveFailures int, alertActive alarmState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.consecutiveFailures = consecutiveFailures
+	c.alertActive = alertActive
+}
+
+// Healthy reports whether the most recent check succeeded
+func (c *checkStatus) Healthy() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return !c.lastCheck.IsZero() && c.lastError == nil
+}
+
+func (c *checkStatus) healthResponse() healthResponse {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	resp := healthResponse{
+		ConsecutiveFailures: c.consecutiveFailures,
+		AlertActive:         c.alertActive == stateFailed,
+	}
+
+	if !c.lastCheck.IsZero() {
+		t := c.lastCheck
+		resp.LastCheck = &t
+	}
+	if !c.lastSuccess.IsZero() {
+		t := c.lastSuccess
+		resp.LastSuccess = &t
+	}
+	if c.lastError != nil {
+		resp.LastError = c.lastError.Error()
+	}
+
+	return resp
+}
+
+// checkState derives the state from the outcome of the most recent check
+func (h healthResponse) checkState() alarmState {
+	switch {
+	case h.LastCheck == nil:
+		return stateUnknown
+	case h.LastError != "":
+		return stateFailed
+	default:
+		return stateOK
+	}
+}
+
+// statusSchemaVersion is increased on incompatible changes of the
+// /status.json response
+const statusSchemaVersion = 1
+
+type statusResponse struct {
+	SchemaVersion int            `json:"schema_version"`
+	Version       string         `json:"version"`
+	Targets       []statusTarget `json:"targets"`
+}
+
+type statusTarget struct {
+	VaultAddress        string            `json:"vault_address"`
+	CheckMode           string            `json:"check_mode"`
+	VaultKey            string            `json:"vault_key"`
+	State               string            `json:"state"`
+	AlertActive         bool              `json:"alert_active"`
+	ConsecutiveFailures int               `json:"consecutive_failures"`
+	LastError           string            `json:"last_error"`
+	LastSuccessTime     *time.Time        `json:"last_success_time"`
+	LastCheckTime       *time.Time        `json:"last_check_time"`
+	Latencies           []statusOperation `json:"latencies"`
+}
+
+type statusOperation struct {
+	Operation string  `json:"operation"`
+	Duration  float64 `json:"duration_seconds"`
+}
+
+// latencies returns the durations of the operations of the most recent
+// check in the order they were executed
+func (c *checkStatus) latencies() []statusOperation {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	ops := []statusOperation{}
+	for _, o := range c.lastResult {
+		ops = append(ops, statusOperation{o.Operation, o.Duration.Seconds()})
+	}
+	return ops
+}
+
+// startHTTPServers starts the configured listeners in the background. If
+// metrics and health endpoint share the same address they are served by the
+// same server.
+func startHTTPServers() {
+	muxes := map[string]*http.ServeMux{}
+	getMux := func(addr string) *http.ServeMux {
+		if _, ok := muxes[addr]; !ok {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if cfg.Listen != "" {
+		getMux(cfg.Listen).Handle("/metrics", basicAuth(http.HandlerFunc(handleMetrics)))
+	}
+
+	if cfg.HealthListen != "" {
+		// The health check stays unauthenticated for probes like the
+		// kubelet ones
+		getMux(cfg.HealthListen).HandleFunc("/healthz", handleHealthz)
+		getMux(cfg.HealthListen).Handle("/history", basicAuth(http.HandlerFunc(handleHistory)))
+		getMux(cfg.HealthListen).Handle("/status.json", basicAuth(http.HandlerFunc(handleStatusJSON)))
+		if cfg.MaintenanceEndpoint {
+			getMux(cfg.HealthListen).Handle("/maintenance", basicAuth(http.HandlerFunc(handleMaintenance)))
+		}
+		getMux(cfg.HealthListen).Handle("/", basicAuth(http.HandlerFunc(handleStatusPage)))
+	}
+
+	for addr, mux := range muxes {
+		go func(addr string, mux *http.ServeMux) {
+			var err error
+			if cfg.ListenTLSCert != "" {
+				logger.Infof("Starting HTTPS server on %s", addr)
+				err = http.ListenAndServeTLS(addr, cfg.ListenTLSCert, cfg.ListenTLSKey, mux)
+			} else {
+				logger.Infof("Starting HTTP server on %s", addr)
+				err = http.ListenAndServe(addr, mux)
+			}
+			if err != nil {
+				logger.Fatalf("HTTP server on %s exited unexpectedly: %s", addr, err)
+			}
+		}(addr, mux)
+	}
+}
+
+// handleHealthz responds with 200 if the most recent checks of all keys
+// succeeded and with 503 if any failed or no check was executed yet
+func handleHealthz(res http.ResponseWriter, r *http.Request) {
+	code := http.StatusOK
+	for _, t := range targets {
+		if !t.status.Healthy() {
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(code)
+	json.NewEncoder(res).Encode(aggregateHealth())
+}
+
+// handleHistory responds with the recent results of all targets ordered by
+// the time of the check
+func handleHistory(res http.ResponseWriter, r *http.Request) {
+	history := []historyEntry{}
+	for _, t := range targets {
+		for _, e := range t.status.History() {
+			e.VaultAddress = t.address
+			e.CheckMode = t.mode
+			e.VaultKey = t.key
+			history = append(history, e)
+		}
+	}
+
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Time.Before(history[j].Time) })
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(history)
+}
+
+// handleStatusJSON responds with the state of all targets in a versioned
+// schema meant to be polled by external aggregation
+func handleStatusJSON(res http.ResponseWriter, r *http.Request) {
+	resp := statusResponse{
+		SchemaVersion: statusSchemaVersion,
+		Version:       version,
+		Targets:       []statusTarget{},
+	}
+
+	for _, t := range targets {
+		h := t.status.healthResponse()
+		resp.Targets = append(resp.Targets, statusTarget{
+			VaultAddress:        t.address,
+			CheckMode:           t.mode,
+			VaultKey:            t.key,
+			State:               h.checkState().String(),
+			AlertActive:         h.AlertActive,
+			ConsecutiveFailures: h.ConsecutiveFailures,
+			LastError:           h.LastError,
+			LastSuccessTime:     h.LastSuccess,
+			LastCheckTime:       h.LastCheck,
+			Latencies:           t.status.latencies(),
+		})
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(resp)
+}
+
+// aggregateHealth combines the status of all targets: the latest check,
+// the oldest success, the highest failure counter and whether any alert is
+// active. With multiple keys the individual states are attached.
+func aggregateHealth() healthResponse {
+	if len(targets) == 1 {
+		return targets[0].status.healthResponse()
+	}
+
+	agg := healthResponse{Keys: map[string]healthResponse{}}
+	for _, t := range targets {
+		h := t.status.healthResponse()
+		agg.Keys[t.name()] = h
+
+		if h.LastCheck != nil && (agg.LastCheck == nil || h.LastCheck.After(*agg.LastCheck)) {
+			agg.LastCheck = h.LastCheck
+		}
+		if h.LastSuccess != nil && (agg.LastSuccess == nil || h.LastSuccess.Before(*agg.LastSuccess)) {
+			agg.LastSuccess = h.LastSuccess
+		}
+		if h.LastError != "" {
+			agg.LastError = h.LastError
+		}
+		if h.ConsecutiveFailures > agg.ConsecutiveFailures {
+			agg.ConsecutiveFailures = h.ConsecutiveFailures
+		}
+		agg.AlertActive = agg.AlertActive || h.AlertActive
+	}
+
+	return agg
+}
+
+// basicAuth requires the credentials of listen-auth for the handler if set,
+// it wraps every endpoint except /healthz
+func basicAuth(next http.Handler) http.Handler {
+	if cfg.ListenAuth == "" {
+		return next
+	}
+
+	parts := strings.SplitN(cfg.ListenAuth, ":", 2)
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(parts[0])) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(parts[1])) != 1 {
+			res.Header().Set("WWW-Authenticate", `Basic realm="vault-rw-monitoring"`)
+			http.Error(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(res, r)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+type logLevel string
+
+const (
+	levelDebug logLevel = "debug"
+	levelInfo  logLevel = "info"
+	levelWarn  logLevel = "warn"
+	levelError logLevel = "error"
+	levelFatal logLevel = "fatal"
+)
+
+// logFields contains additional context attached to a log line
+type logFields map[string]interface{}
+
+// logEntry is a minimal leveled logger writing either the classic text
+// format of the log package or one JSON object per line
+type logEntry struct {
+	fields logFields
+}
+
+var logger = logEntry{}
+
+// WithFields returns a copy of the entry having the given fields attached
+func (l logEntry) WithFields(fields logFields) logEntry {
+	merged := logFields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return logEntry{fields: merged}
+}
+
+// Debugf logs only if verbose output is enabled
+func (l logEntry) Debugf(format string, args ...interface{}) {
+	if cfg.Verbose {
+		l.write(levelDebug, fmt.Sprintf(format, args...))
+	}
+}
+
+// Infof logs routine messages and is suppressed in quiet mode
+func (l logEntry) Infof(format string, args ...interface{}) {
+	if !cfg.Quiet {
+		l.write(levelInfo, fmt.Sprintf(format, args...))
+	}
+}
+
+// Noticef logs with info level even in quiet mode and is used for the
+// startup banner and state transitions
+func (l logEntry) Noticef(format string, args ...interface{}) {
+	l.write(levelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l logEntry) Warnf(format string, args ...interface{}) {
+	l.write(levelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l logEntry) Errorf(format string, args ...interface{}) {
+	l.write(levelError, fmt.Sprintf(format, args...))
+}
+
+// Fatalf logs the message and exits the process with a non-zero status
+func (l logEntry) Fatalf(format string, args ...interface{}) {
+	l.write(levelFatal, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func (l logEntry) write(level logLevel, msg string) {
+	if cfg.LogFormat == logFormatJSON {
+		line := logFields{}
+		for k, v := range l.fields {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			line[k] = v
+		}
+		line["level"] = level
+		line["msg"] = msg
+		line["timestamp"] = time.Now().Format(time.RFC3339Nano)
+
+		if err := json.NewEncoder(os.Stderr).Encode(line); err != nil {
+			log.Printf("Unable to encode log line: %s (%s)", err, msg)
+		}
+		return
+	}
+
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{msg}
+	for _, k := range keys {
+		v := fmt.Sprintf("%v", l.fields[k])
+		if strings.ContainsAny(v, " \t\n\"") {
+			v = strconv.Quote(v)
+		}
+		parts = append(parts, k+"="+v)
+	}
+
+	log.Print(strings.Join(parts, " "))
+}
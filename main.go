@@ -1,26 +1,27 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
-	"net/http"
+	"math/rand"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/Luzifer/rconfig"
-	"github.com/hashicorp/vault/api"
-	uuid "github.com/satori/go.uuid"
 )
 
-const (
-	eventURL  = "https://events.pagerduty.com/generic/2010-04-15/create_event.json"
-	clientURL = "https://github.com/Jimdo/vault-rw-monitoring"
-)
+// minCheckInterval prevents hammering Vault and the notifiers through a
+// misconfigured interval
+const minCheckInterval = time.Second
 
 type alarmState uint
 
@@ -30,168 +31,1096 @@ const (
 	stateFailed
 )
 
+func (a alarmState) String() string {
+	switch a {
+	case stateOK:
+		return "ok"
+	case stateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
 var (
 	cfg = struct {
-		VaultAddress string `flag:"vault-address" default:"http://localhost:8200" env:"VAULT_ADDR" description:"Address of the Vault instance"`
-		VaultKey     string `flag:"vault-key" default:"/secret/vault-rw-monitoring" env:"VAULT_KEY" description:"Key to use for read/write test"`
-		VaultToken   string `flag:"vault-token" default:"" env:"VAULT_TOKEN" description:"Token to access the key specified in vault-key"`
+		VaultAddress         string        `flag:"vault-address" vardefault:"vault-address" default:"http://localhost:8200" env:"VAULT_ADDR" description:"Address of the Vault instance, unix:///path/to/socket connects through a Unix domain socket"`
+		VaultAddresses       []string      `flag:"vault-addresses" vardefault:"vault-addresses" default:"" env:"VAULT_ADDRESSES" description:"Comma separated list of Vault nodes to test individually, overrides vault-address"`
+		VaultKey             string        `flag:"vault-key" vardefault:"vault-key" default:"/secret/vault-rw-monitoring" env:"VAULT_KEY" description:"Key to use for read/write test"`
+		VaultKeys            []string      `flag:"vault-keys" vardefault:"vault-keys" default:"" env:"VAULT_KEYS" description:"Comma separated list of keys to test, overrides vault-key"`
+		TestField            string        `flag:"test-field" vardefault:"test-field" default:"value" env:"TEST_FIELD" description:"Name of the field written to and read from the test key"`
+		TestFields           int           `flag:"test-fields" vardefault:"test-fields" default:"1" env:"TEST_FIELDS" description:"Number of fields with distinct values written in one write and verified, additional fields are suffixed with their number (e.g. value_2)"`
+		PayloadSize          int           `flag:"payload-size" vardefault:"payload-size" default:"0" env:"PAYLOAD_SIZE" description:"Number of random bytes written per field and verified by their SHA-256 checksum instead of a UUID (0 to write a UUID)"`
+		FixedValue           string        `flag:"fixed-value" vardefault:"fixed-value" default:"" env:"FIXED_VALUE" description:"Constant value to write and verify instead of a fresh UUID per check (stale reads of a previous write are not detected)"`
+		VaultToken           string        `flag:"vault-token" vardefault:"vault-token" default:"" env:"VAULT_TOKEN" description:"Token to access the key specified in vault-key"`
+		VaultTokenFile       string        `flag:"vault-token-file" vardefault:"vault-token-file" default:"" env:"VAULT_TOKEN_FILE" description:"File to read the token from, re-read on every check (preferred over vault-token)"`
+		VaultNamespace       string        `flag:"vault-namespace" vardefault:"vault-namespace" default:"" env:"VAULT_NAMESPACE" description:"Vault Enterprise namespace to execute the test in"`
+		VaultRoleID          string        `flag:"vault-role-id" vardefault:"vault-role-id" default:"" env:"VAULT_ROLE_ID" description:"AppRole role-id to log in with instead of using vault-token"`
+		VaultSecretID        string        `flag:"vault-secret-id" vardefault:"vault-secret-id" default:"" env:"VAULT_SECRET_ID" description:"AppRole secret-id to log in with instead of using vault-token"`
+		VaultAuth            string        `flag:"vault-auth-method" vardefault:"vault-auth-method" default:"" env:"VAULT_AUTH_METHOD" description:"Auth method to obtain the token with (token, approle, kubernetes or cert), derived from the given credentials if empty"`
+		VaultK8sRole         string        `flag:"vault-k8s-role" vardefault:"vault-k8s-role" default:"" env:"VAULT_K8S_ROLE" description:"Role to log in with using the kubernetes auth method"`
+		VaultCertRole        string        `flag:"vault-cert-role" vardefault:"vault-cert-role" default:"" env:"VAULT_CERT_ROLE" description:"Certificate role to log in with using the cert auth method, matched against all roles if empty"`
+		VaultK8sJWT          string        `flag:"vault-k8s-jwt-path" vardefault:"vault-k8s-jwt-path" default:"/var/run/secrets/kubernetes.io/serviceaccount/token" env:"VAULT_K8S_JWT_PATH" description:"Path of the service account JWT used for the kubernetes auth method"`
+		VaultHeaders         []string      `flag:"vault-header" vardefault:"vault-header" default:"" env:"VAULT_HEADERS" description:"Header to send with every Vault request in format key=value (repeatable)"`
+		UserAgent            string        `flag:"user-agent" vardefault:"user-agent" default:"" env:"USER_AGENT" description:"User-Agent sent with Vault and notifier requests (default vault-rw-monitoring/<version>)"`
+		RequestIDHeader      string        `flag:"request-id-header" vardefault:"request-id-header" default:"X-Request-Id" env:"REQUEST_ID_HEADER" description:"Header to send a unique ID per check and request in, logged for failed checks (Vault audits it once added through sys/config/auditing/request-headers, disabled if empty)"`
+		KVVersion            int           `flag:"kv-version" vardefault:"kv-version" default:"1" env:"KV_VERSION" description:"Version of the KV secret engine mounted at vault-key (1 or 2)"`
+		SkipDelete           bool          `flag:"skip-delete" vardefault:"skip-delete" default:"false" env:"SKIP_DELETE" description:"Do not delete the test key for tokens without delete permission, the key (and with kv-version 2 its versions) remains until cleaned up externally"`
+		ConfirmDelete        bool          `flag:"confirm-delete-propagation" vardefault:"confirm-delete-propagation" default:"false" env:"CONFIRM_DELETE_PROPAGATION" description:"Read the key after deleting it and fail the check if it is still readable"`
+		Operations           []string      `flag:"operations" vardefault:"operations" default:"write,read,delete" env:"OPERATIONS" description:"Comma separated sequence of operations of the kv check (write, read, delete), reads verify the last written value or after a delete that the key is gone"`
+		WriteIterations      int           `flag:"write-iterations" vardefault:"write-iterations" default:"1" env:"WRITE_ITERATIONS" description:"How often every write of the kv check is repeated with distinct values, the following read verifies the last one"`
+		CheckModes           []string      `flag:"check-mode" vardefault:"check-mode" default:"kv" env:"CHECK_MODE" description:"Comma separated secret engines to check every interval (kv, transit, database, wrapping or replication)"`
+		TransitKey           string        `flag:"transit-key" vardefault:"transit-key" default:"transit/vault-rw-monitoring" env:"TRANSIT_KEY" description:"Transit key to encrypt and decrypt with in check-mode transit (format: mount/name)"`
+		DatabaseRole         string        `flag:"database-role" vardefault:"database-role" default:"database/vault-rw-monitoring" env:"DATABASE_ROLE" description:"Database role in format mount/role to request credentials for in check-mode database"`
+		WrapTTL              time.Duration `flag:"wrap-ttl" vardefault:"wrap-ttl" default:"60s" env:"WRAP_TTL" description:"TTL of the wrapping token created in check-mode wrapping"`
+		ReplicationSecondary string        `flag:"replication-secondary" vardefault:"replication-secondary" default:"" env:"REPLICATION_SECONDARY" description:"Address of the performance secondary to read the key written to vault-address from in check-mode replication, the token needs to be valid on both clusters"`
+		ReplicationMaxLag    time.Duration `flag:"replication-max-lag" vardefault:"replication-max-lag" default:"5s" env:"REPLICATION_MAX_LAG" description:"Maximum time for a write to arrive on the replication-secondary in check-mode replication"`
 
-		PagerDutyIntegrationKey string `flag:"pagerduty-key" default:"" env:"PAGERDUTY_KEY" description:"Integration key for the Generic API service in PagerDuty"`
+		VaultCACert        string `flag:"vault-ca-cert" vardefault:"vault-ca-cert" default:"" env:"VAULT_CACERT" description:"Path to a PEM encoded CA certificate to verify the Vault server certificate"`
+		VaultClientCert    string `flag:"vault-client-cert" vardefault:"vault-client-cert" default:"" env:"VAULT_CLIENT_CERT" description:"Path to a PEM encoded client certificate for TLS authentication to Vault"`
+		VaultClientKey     string `flag:"vault-client-key" vardefault:"vault-client-key" default:"" env:"VAULT_CLIENT_KEY" description:"Path to the unencrypted PEM encoded private key matching the client certificate"`
+		VaultTLSSkipVerify bool   `flag:"vault-tls-skip-verify" vardefault:"vault-tls-skip-verify" default:"false" env:"VAULT_SKIP_VERIFY" description:"Do not verify the Vault server certificate (insecure!)"`
 
-		CheckInterval  time.Duration `flag:"interval" default:"30s" env:"INTERVAL" description:"Interval to execute the test"`
-		AlertThreshold int           `flag:"threshold" default:"4" env:"THRESHOLD" description:"How often to fail before sending PagerDuty alerts"`
+		PagerDutyIntegrationKeys []string      `flag:"pagerduty-key" vardefault:"pagerduty-key" default:"" env:"PAGERDUTY_KEY" description:"Comma separated integration keys for the Events API v2 services in PagerDuty, alerts are sent to all of them. Keys in format vault://path#field are read from Vault."`
+		PagerDutyKeyFile         string        `flag:"pagerduty-key-file" vardefault:"pagerduty-key-file" default:"" env:"PAGERDUTY_KEY_FILE" description:"File to read additional integration keys from (one per line), re-read on SIGHUP together with keys from Vault"`
+		IncidentKey              string        `flag:"incident-key" vardefault:"incident-key" default:"" env:"INCIDENT_KEY" description:"Incident key (PagerDuty dedup key, OpsGenie alias) used instead of the one derived from address, namespace and key"`
+		PagerDutyURL             string        `flag:"pagerduty-url" vardefault:"pagerduty-url" default:"https://events.pagerduty.com/v2/enqueue" env:"PAGERDUTY_URL" description:"URL of the PagerDuty Events API v2 endpoint"`
+		PagerDutySeverity        string        `flag:"pagerduty-severity" vardefault:"pagerduty-severity" default:"critical" env:"PAGERDUTY_SEVERITY" description:"Severity of the PagerDuty alerts (critical, error, warning or info)"`
+		PagerDutySeverityMap     []string      `flag:"pagerduty-severity-map" vardefault:"pagerduty-severity-map" default:"" env:"PAGERDUTY_SEVERITY_MAP" description:"Comma separated severities overriding pagerduty-severity per error class in format class=severity (e.g. data=critical,auth=error)"`
+		NoAutoResolve            bool          `flag:"no-auto-resolve" vardefault:"no-auto-resolve" default:"false" env:"NO_AUTO_RESOLVE" description:"Never resolve PagerDuty incidents, leaving their closure to a human"`
+		EscalateAfter            time.Duration `flag:"escalate-after" vardefault:"escalate-after" default:"0" env:"ESCALATE_AFTER" description:"Trigger the PagerDuty alert again with critical severity when the checks keep failing for this duration (0 to disable)"`
+		AlertTemplate            string        `flag:"alert-template" vardefault:"alert-template" default:"" env:"ALERT_TEMPLATE" description:"Go text/template for the alert description (fields: .VaultAddress, .CheckMode, .VaultKey, .Threshold, .FailureCount, .LastError)"`
+		SlackWebhook             string        `flag:"slack-webhook" vardefault:"slack-webhook" default:"" env:"SLACK_WEBHOOK" description:"URL of a Slack incoming webhook to notify about alerts"`
+		TeamsWebhook             string        `flag:"teams-webhook" vardefault:"teams-webhook" default:"" env:"TEAMS_WEBHOOK" description:"URL of a Microsoft Teams incoming webhook to notify about alerts"`
+		DiscordWebhook           string        `flag:"discord-webhook" vardefault:"discord-webhook" default:"" env:"DISCORD_WEBHOOK" description:"URL of a Discord webhook to notify about alerts"`
+		OpsGenieKey              string        `flag:"opsgenie-key" vardefault:"opsgenie-key" default:"" env:"OPSGENIE_KEY" description:"API key of an OpsGenie API integration to create alerts with"`
+		OpsGenieRegion           string        `flag:"opsgenie-region" vardefault:"opsgenie-region" default:"us" env:"OPSGENIE_REGION" description:"Region of the OpsGenie account (us or eu)"`
+		WebhookURL               string        `flag:"webhook-url" vardefault:"webhook-url" default:"" env:"WEBHOOK_URL" description:"URL to POST a JSON body to on every alert transition"`
+		WebhookTemplate          string        `flag:"webhook-template" vardefault:"webhook-template" default:"" env:"WEBHOOK_TEMPLATE" description:"Go text/template rendering the JSON body for the webhook-url (fields: .State, .Kind, .VaultAddress, .VaultKey, .IncidentKey, .Threshold, .FailureCount, .LastError, .Tags)"`
+		WebhookHeaders           []string      `flag:"webhook-header" vardefault:"webhook-header" default:"" env:"WEBHOOK_HEADERS" description:"Header to send with webhook requests in format key=value (repeatable)"`
+		SMTPHost                 string        `flag:"smtp-host" vardefault:"smtp-host" default:"" env:"SMTP_HOST" description:"Host of the SMTP server to send alert emails through"`
+		SMTPPort                 int           `flag:"smtp-port" vardefault:"smtp-port" default:"587" env:"SMTP_PORT" description:"Port of the SMTP server"`
+		SMTPUser                 string        `flag:"smtp-user" vardefault:"smtp-user" default:"" env:"SMTP_USER" description:"User to authenticate at the SMTP server with, no authentication if empty"`
+		SMTPPassword             string        `flag:"smtp-pass" vardefault:"smtp-pass" default:"" env:"SMTP_PASS" description:"Password to authenticate at the SMTP server with"`
+		SMTPFrom                 string        `flag:"smtp-from" vardefault:"smtp-from" default:"" env:"SMTP_FROM" description:"Sender address of the alert emails"`
+		SMTPTo                   []string      `flag:"smtp-to" vardefault:"smtp-to" default:"" env:"SMTP_TO" description:"Comma separated list of recipients of the alert emails"`
+		SMTPTLS                  string        `flag:"smtp-tls" vardefault:"smtp-tls" default:"starttls" env:"SMTP_TLS" description:"TLS mode of the SMTP connection (starttls, tls for implicit TLS or none)"`
+		MinNotifyInterval        time.Duration `flag:"min-notify-interval" vardefault:"min-notify-interval" default:"0" env:"MIN_NOTIFY_INTERVAL" description:"Minimum interval between identical notifications to a notifier, earlier ones are suppressed and retried with the next check (0 to disable)"`
+		Tags                     []string      `flag:"tag" vardefault:"tag" default:"" env:"TAGS" description:"Tag in format key=value attached to all notifications and metrics and folded into the incident key (repeatable)"`
+		NotifyTimeout            time.Duration `flag:"notify-timeout" vardefault:"notify-timeout" default:"10s" env:"NOTIFY_TIMEOUT" description:"Timeout for every request sent by the notifiers"`
 
-		VersionAndExit bool `flag:"version" default:"false" description:"Prints current version and exits"`
-		Verbose        bool `flag:"verbose,v" default:"false" description:"Enable verbose output"`
+		CheckInterval         time.Duration `flag:"interval" vardefault:"interval" default:"30s" env:"INTERVAL" description:"Interval to execute the test"`
+		AlertThreshold        int           `flag:"threshold" vardefault:"threshold" default:"4" env:"THRESHOLD" description:"How often to fail before sending PagerDuty alerts"`
+		TriggerOnFirstFailure bool          `flag:"trigger-on-first-failure" vardefault:"trigger-on-first-failure" default:"false" env:"TRIGGER_ON_FIRST_FAILURE" description:"Trigger all notifiers on the first failure, overriding threshold and notifier-thresholds"`
+		NotifierThresholds    []string      `flag:"notifier-thresholds" vardefault:"notifier-thresholds" default:"" env:"NOTIFIER_THRESHOLDS" description:"Comma separated thresholds overriding threshold for single notifiers in format name=threshold (e.g. slack=1,pagerduty=6)"`
+		ResolveThreshold      int           `flag:"resolve-threshold" vardefault:"resolve-threshold" default:"1" env:"RESOLVE_THRESHOLD" description:"How many consecutive successful checks are required before resolving alerts"`
+		LatencyThreshold      time.Duration `flag:"latency-threshold" vardefault:"latency-threshold" default:"0" env:"LATENCY_THRESHOLD" description:"Duration a single operation may take before the check is counted as slow (0 to disable)"`
+		Backoff               bool          `flag:"backoff" vardefault:"backoff" default:"false" env:"BACKOFF" description:"Delay checks exponentially while the checks are failing"`
+		BackoffMax            time.Duration `flag:"backoff-max" vardefault:"backoff-max" default:"5m" env:"BACKOFF_MAX" description:"Maximum delay between checks in backoff mode"`
+		OperationRetries      int           `flag:"operation-retries" vardefault:"operation-retries" default:"0" env:"OPERATION_RETRIES" description:"How often to retry a failed write, read or delete before failing the check"`
+		CircuitBreaker        int           `flag:"circuit-breaker" vardefault:"circuit-breaker" default:"0" env:"CIRCUIT_BREAKER" description:"Number of consecutive connection failures after which only the seal status is probed until Vault is reachable again (0 to disable)"`
+		ReadRetries           int           `flag:"read-retries" vardefault:"read-retries" default:"0" env:"READ_RETRIES" description:"How often to read the key again if it does not contain the written value, for eventually consistent storage backends"`
+		ReadRetryDelay        time.Duration `flag:"read-retry-delay" vardefault:"read-retry-delay" default:"500ms" env:"READ_RETRY_DELAY" description:"Delay before reading the key again after a mismatch"`
+		CheckTimeout          time.Duration `flag:"check-timeout" vardefault:"check-timeout" default:"0" env:"CHECK_TIMEOUT" description:"Timeout for the whole check including all operations and retries (0 to disable)"`
+		Concurrency           int           `flag:"concurrency" vardefault:"concurrency" default:"1" env:"CONCURRENCY" description:"Number of targets checked in parallel every interval, targets sharing a key are checked one after another"`
+		OperationTimeout      time.Duration `flag:"operation-timeout" vardefault:"operation-timeout" default:"10s" env:"OPERATION_TIMEOUT" description:"Timeout for every attempt of a write, read or delete"`
+		TokenTTLWarning       time.Duration `flag:"token-ttl-warning" vardefault:"token-ttl-warning" default:"0" env:"TOKEN_TTL_WARNING" description:"Send a warning when the TTL of the vault-token drops below this duration (0 to disable)"`
+		StartupGrace          time.Duration `flag:"startup-grace" vardefault:"startup-grace" default:"0" env:"STARTUP_GRACE" description:"Duration after the start in which failed checks are logged but do not count towards the threshold"`
+		IgnoreStatusCodes     []string      `flag:"ignore-status-codes" vardefault:"ignore-status-codes" default:"" env:"IGNORE_STATUS_CODES" description:"Comma separated HTTP status codes of Vault (e.g. 503 during leader elections) for which failed checks are logged but do not count towards the threshold"`
+		StartJitter           time.Duration `flag:"start-jitter" vardefault:"start-jitter" default:"0" env:"START_JITTER" description:"Delay the startup probe and the first check by a random duration up to this value"`
+		MaintenanceUntil      string        `flag:"maintenance-until" vardefault:"maintenance-until" default:"" env:"MAINTENANCE_UNTIL" description:"RFC3339 timestamp until which failures are counted but no alerts are triggered"`
+		MaintenanceEndpoint   bool          `flag:"maintenance-endpoint" vardefault:"maintenance-endpoint" default:"false" env:"MAINTENANCE_ENDPOINT" description:"Serve /maintenance on the health listener to set the maintenance window at runtime (requires listen-auth)"`
+
+		Listen          string `flag:"listen" vardefault:"listen" default:"" env:"LISTEN" description:"Address to listen on for the metrics endpoint (e.g. :9090), disabled if empty"`
+		HealthListen    string `flag:"health-listen" vardefault:"health-listen" default:"" env:"HEALTH_LISTEN" description:"Address to listen on for the health endpoint (e.g. :8080), disabled if empty"`
+		ListenTLSCert   string `flag:"listen-tls-cert" vardefault:"listen-tls-cert" default:"" env:"LISTEN_TLS_CERT" description:"Certificate to serve the metrics and health endpoints with over HTTPS"`
+		ListenTLSKey    string `flag:"listen-tls-key" vardefault:"listen-tls-key" default:"" env:"LISTEN_TLS_KEY" description:"Private key of the listen-tls-cert"`
+		ListenAuth      string `flag:"listen-auth" vardefault:"listen-auth" default:"" env:"LISTEN_AUTH" description:"Credentials in format user:password required through basic auth for all endpoints except /healthz"`
+		ExternalURL     string `flag:"external-url" vardefault:"external-url" default:"" env:"EXTERNAL_URL" description:"Publicly reachable base URL of the health listener, PagerDuty incidents link to its status page"`
+		HistorySize     int    `flag:"history-size" vardefault:"history-size" default:"100" env:"HISTORY_SIZE" description:"Number of recent check results per key served at /history of the health endpoint (0 to disable)"`
+		AuditLog        string `flag:"audit-log" vardefault:"audit-log" default:"" env:"AUDIT_LOG" description:"File to append one JSON line per check to, reopened on SIGHUP (disabled if empty)"`
+		AuditLogMaxSize int    `flag:"audit-log-max-size" vardefault:"audit-log-max-size" default:"0" env:"AUDIT_LOG_MAX_SIZE" description:"Size in MiB after which the audit-log is rotated to a single backup with suffix .1 (0 to disable)"`
+		StateFile       string `flag:"state-file" vardefault:"state-file" default:"" env:"STATE_FILE" description:"File to persist the alert state to and restore it from at startup to continue incidents across restarts (disabled if empty)"`
+
+		ResolveOnExit  bool `flag:"resolve-on-exit" vardefault:"resolve-on-exit" default:"false" env:"RESOLVE_ON_EXIT" description:"Resolve an active alert when shutting down"`
+		CleanupOnStart bool `flag:"cleanup-on-start" vardefault:"cleanup-on-start" default:"true" env:"CLEANUP_ON_START" description:"Delete test keys left over by a previous run on startup"`
+
+		Once            bool          `flag:"once" vardefault:"once" default:"false" env:"ONCE" description:"Execute a single check, report the result through the exit code and exit"`
+		FailFast        bool          `flag:"fail-fast" vardefault:"fail-fast" default:"false" env:"FAIL_FAST" description:"Exit with status 1 if the probe executed at startup, after the start-jitter, fails"`
+		MaxRuntime      time.Duration `flag:"max-runtime" vardefault:"max-runtime" default:"0" env:"MAX_RUNTIME" description:"Exit after this duration with a summary of the executed checks (0 to run forever)"`
+		MaxRuntimeFail  bool          `flag:"max-runtime-fail" vardefault:"max-runtime-fail" default:"false" env:"MAX_RUNTIME_FAIL" description:"Exit with status 1 after max-runtime if any check failed"`
+		SendTestAlert   bool          `flag:"send-test-alert" default:"false" description:"Send a test alert and its resolve to PagerDuty and exit"`
+		VerifyNotifiers bool          `flag:"verify-notifiers" default:"false" description:"Send a test alert and its resolve through every configured notifier, report the results and exit"`
+
+		ConfigFile     string `flag:"config" default:"" env:"CONFIG" description:"YAML or JSON file to read the defaults of all options from (overridden by environment and flags)"`
+		ConsulAddr     string `flag:"consul-addr" vardefault:"consul-addr" default:"" env:"CONSUL_HTTP_ADDR" description:"Address of the Consul agent to read vault-address, vault-key and interval from at startup (overridden by environment and flags, disabled if empty)"`
+		ConsulPrefix   string `flag:"consul-prefix" vardefault:"consul-prefix" default:"vault-rw-monitoring" env:"CONSUL_PREFIX" description:"Consul KV prefix containing the options as keys named like the flags"`
+		ConsulToken    string `flag:"consul-token" vardefault:"consul-token" default:"" env:"CONSUL_HTTP_TOKEN" description:"ACL token to read the Consul KV prefix with"`
+		Describe       bool   `flag:"describe" default:"false" description:"Print the effective configuration with redacted secrets as JSON and exit"`
+		VersionAndExit bool   `flag:"version" default:"false" description:"Prints current version and exits"`
+		Verbose        bool   `flag:"verbose,v" vardefault:"verbose" default:"false" description:"Enable verbose output"`
+		Quiet          bool   `flag:"quiet,q" vardefault:"quiet" default:"false" env:"QUIET" description:"Only log failures, errors and state transitions, suppressing routine messages like successful checks"`
+		LogFormat      string `flag:"log-format" vardefault:"log-format" default:"text" env:"LOG_FORMAT" description:"Format of the log output (text or json)"`
 	}{}
 
-	version             = "dev"
-	currentAlertCounter int
-	alertActive         alarmState
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+
+	targets []*checkTarget
+
+	// startTime is used to determine the end of the startup-grace
+	startTime = time.Now()
 )
 
-func init() {
+// configure reads and validates the options. It is called by main
+// instead of init to not parse the command line of the tests.
+func configure() {
+	// Seeded for the start-jitter and backoff jitter to differ between
+	// instances started at the same time
+	rand.Seed(time.Now().UnixNano())
+
+	if err := loadConfigFile(); err != nil {
+		logger.Fatalf("Unable to read config file: %s", err)
+	}
+
 	if err := rconfig.Parse(&cfg); err != nil {
-		log.Fatalf("Unable to parse commandline options: %s", err)
+		logger.Fatalf("Unable to parse commandline options: %s", err)
+	}
+
+	if err := loadConsulConfig(); err != nil {
+		logger.Fatalf("Unable to read config from Consul: %s", err)
 	}
 
 	if cfg.VersionAndExit {
-		fmt.Printf("vault-rw-monitoring %s\n", version)
+		printVersion()
 		os.Exit(0)
 	}
 
-	if cfg.VaultToken == "" {
-		log.Fatalf("You need to provide a vault-token")
+	metricBuildInfo.Set(1, version, commit, buildDate)
+
+	if cfg.SendTestAlert && !pagerDutyConfigured() {
+		logger.Fatalf("You need to provide a PagerDuty service key to send a test alert")
+	}
+
+	switch vaultAuthMethod() {
+	case authMethodToken:
+		if cfg.VaultToken == "" && cfg.VaultTokenFile == "" && !cfg.SendTestAlert && !cfg.VerifyNotifiers {
+			logger.Fatalf("You need to provide a vault-token, a vault-token-file, a vault-role-id or a vault-auth-method")
+		}
+
+	case authMethodAppRole:
+		if cfg.VaultRoleID == "" {
+			logger.Fatalf("You need to provide a vault-role-id to use the approle auth method")
+		}
+
+	case authMethodKubernetes:
+		if cfg.VaultK8sRole == "" {
+			logger.Fatalf("You need to provide a vault-k8s-role to use the kubernetes auth method")
+		}
+
+	case authMethodCert:
+		if cfg.VaultClientCert == "" || cfg.VaultClientKey == "" {
+			logger.Fatalf("You need to provide vault-client-cert and vault-client-key to use the cert auth method")
+		}
+
+	default:
+		logger.Fatalf("Unsupported vault-auth-method %q, supported are: token, approle, kubernetes, cert", cfg.VaultAuth)
+	}
+
+	if cfg.VaultToken != "" && cfg.VaultTokenFile != "" {
+		logger.Warnf("Both vault-token and vault-token-file are set, using the token from the file")
+	}
+
+	if cfg.LogFormat != logFormatText && cfg.LogFormat != logFormatJSON {
+		logger.Fatalf("Unsupported log-format %q, only %q and %q are supported", cfg.LogFormat, logFormatText, logFormatJSON)
+	}
+
+	if cfg.Quiet && cfg.Verbose {
+		logger.Fatalf("quiet can not be used together with verbose")
+	}
+
+	if cfg.KVVersion != 1 && cfg.KVVersion != 2 {
+		logger.Fatalf("Unsupported kv-version %d, only 1 and 2 are supported", cfg.KVVersion)
+	}
+
+	if len(checkModes()) == 0 {
+		logger.Fatalf("You need to provide at least one check-mode")
+	}
+	for i, mode := range checkModes() {
+		if !stringInSlice(mode, []string{checkModeKV, checkModeTransit, checkModeDatabase, checkModeWrapping, checkModeReplication}) {
+			logger.Fatalf("Unsupported check-mode %q, supported are: kv, transit, database, wrapping, replication", mode)
+		}
+		if stringInSlice(mode, checkModes()[:i]) {
+			logger.Fatalf("check-mode %q is given multiple times", mode)
+		}
+	}
+
+	if stringInSlice(checkModeReplication, checkModes()) {
+		switch {
+		case cfg.ReplicationSecondary == "":
+			logger.Fatalf("You need to provide replication-secondary for check-mode replication")
+		case cfg.ReplicationMaxLag <= 0:
+			logger.Fatalf("replication-max-lag must be positive")
+		case cfg.FixedValue != "":
+			logger.Fatalf("fixed-value can not be used with check-mode replication as the previous write would be read")
+		}
+	}
+
+	if cfg.WrapTTL < time.Second {
+		logger.Fatalf("wrap-ttl must be at least 1s")
+	}
+
+	if len(nonEmpty(cfg.Operations)) == 0 {
+		logger.Fatalf("operations must contain at least one operation")
+	}
+	for _, op := range nonEmpty(cfg.Operations) {
+		if !stringInSlice(op, []string{"write", "read", "delete"}) {
+			logger.Fatalf("Unsupported operation %q, supported are: write, read, delete", op)
+		}
+	}
+
+	if cfg.Concurrency < 1 {
+		logger.Fatalf("concurrency must be at least 1")
+	}
+
+	if cfg.WriteIterations < 1 {
+		logger.Fatalf("write-iterations must be at least 1")
+	}
+
+	if cfg.SkipDelete && cfg.ConfirmDelete {
+		logger.Fatalf("confirm-delete-propagation can not be used together with skip-delete")
+	}
+
+	if cfg.CircuitBreaker < 0 {
+		logger.Fatalf("circuit-breaker must not be negative")
+	}
+
+	if cfg.OperationRetries < 0 || cfg.OperationTimeout <= 0 {
+		logger.Fatalf("operation-retries must not be negative and operation-timeout must be positive")
+	}
+
+	if cfg.MaintenanceEndpoint && (cfg.HealthListen == "" || cfg.ListenAuth == "") {
+		logger.Fatalf("maintenance-endpoint requires health-listen and listen-auth")
+	}
+
+	if cfg.MaintenanceUntil != "" {
+		until, err := time.Parse(time.RFC3339, cfg.MaintenanceUntil)
+		if err != nil {
+			logger.Fatalf("maintenance-until must be a RFC3339 timestamp: %s", err)
+		}
+		setMaintenanceUntil(until)
+	}
+
+	if cfg.AuditLogMaxSize < 0 {
+		logger.Fatalf("audit-log-max-size must not be negative")
 	}
 
-	if cfg.PagerDutyIntegrationKey == "" {
-		log.Fatalf("You need to provide a PagerDuty service key")
+	if cfg.ReadRetries < 0 || cfg.ReadRetryDelay < 0 {
+		logger.Fatalf("read-retries and read-retry-delay must not be negative")
+	}
+
+	if cfg.CheckInterval < minCheckInterval {
+		logger.Fatalf("interval must be at least %s", minCheckInterval)
+	}
+
+	if cfg.BackoffMax <= 0 {
+		logger.Fatalf("backoff-max must be positive")
+	}
+
+	if cfg.AlertThreshold < 1 {
+		logger.Fatalf("threshold must be at least 1")
+	}
+
+	if cfg.ResolveThreshold < 1 {
+		logger.Fatalf("resolve-threshold must be at least 1")
+	}
+
+	if cfg.TokenTTLWarning > 0 && usesVaultLogin() {
+		logger.Warnf("token-ttl-warning only applies to static tokens, tokens obtained by login are refreshed automatically")
+	}
+
+	if cfg.TestField == "" {
+		logger.Fatalf("You need to provide a test-field")
+	}
+
+	if cfg.TestFields < 1 {
+		logger.Fatalf("test-fields must be at least 1")
+	}
+
+	if cfg.PayloadSize < 0 {
+		logger.Fatalf("payload-size must not be negative")
+	}
+
+	if cfg.FixedValue != "" && cfg.PayloadSize > 0 {
+		logger.Fatalf("fixed-value and payload-size can not be combined")
+	}
+
+	if (cfg.ListenTLSCert == "") != (cfg.ListenTLSKey == "") {
+		logger.Fatalf("You need to provide both listen-tls-cert and listen-tls-key")
+	}
+
+	if cfg.ListenTLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.ListenTLSCert, cfg.ListenTLSKey); err != nil {
+			logger.Fatalf("Unable to load listen-tls-cert: %s", err)
+		}
+	}
+
+	if cfg.ListenAuth != "" && !strings.Contains(cfg.ListenAuth, ":") {
+		logger.Fatalf("listen-auth must be in format user:password")
+	}
+
+	if cfg.ExternalURL != "" {
+		if u, err := url.Parse(cfg.ExternalURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			logger.Fatalf("external-url must be an absolute http or https URL")
+		}
+		if cfg.HealthListen == "" {
+			logger.Warnf("external-url is set but health-listen is not, the linked status page is not served")
+		}
+	}
+
+	if (cfg.VaultClientCert == "") != (cfg.VaultClientKey == "") {
+		logger.Fatalf("You need to provide both vault-client-cert and vault-client-key")
+	}
+
+	if cfg.VaultTLSSkipVerify {
+		logger.Warnf("TLS verification of the Vault server is disabled, do not use this in production")
+	}
+
+	var err error
+	if vaultHeaders, err = parseHeaders(cfg.VaultHeaders); err != nil {
+		logger.Fatalf("Invalid vault-header: %s", err)
+	}
+
+	if tags, err = parseTags(cfg.Tags); err != nil {
+		logger.Fatalf("Invalid tag: %s", err)
+	}
+
+	targets = configuredTargets()
+
+	if cfg.StateFile != "" {
+		stateStorage = fileStateStore{path: cfg.StateFile}
+	}
+
+	if !stringInSlice(cfg.PagerDutySeverity, pagerDutySeverities) {
+		logger.Fatalf("Unsupported pagerduty-severity %q, supported are: %s", cfg.PagerDutySeverity, strings.Join(pagerDutySeverities, ", "))
+	}
+
+	if pagerDutySeverityMap, err = parseSeverityMap(cfg.PagerDutySeverityMap); err != nil {
+		logger.Fatalf("Invalid pagerduty-severity-map: %s", err)
+	}
+
+	if cfg.NoAutoResolve && cfg.ResolveOnExit {
+		logger.Warnf("resolve-on-exit does not resolve PagerDuty incidents as no-auto-resolve is set")
+	}
+
+	if cfg.EscalateAfter > 0 && cfg.PagerDutySeverity == "critical" {
+		logger.Warnf("escalate-after has no effect on the severity as pagerduty-severity is already critical")
+	}
+
+	if cfg.OpsGenieRegion != "us" && cfg.OpsGenieRegion != "eu" {
+		logger.Fatalf("Unsupported opsgenie-region %q, only us and eu are supported", cfg.OpsGenieRegion)
+	}
+
+	if cfg.SMTPHost != "" {
+		if cfg.SMTPFrom == "" || len(nonEmpty(cfg.SMTPTo)) == 0 {
+			logger.Fatalf("You need to provide smtp-from and smtp-to to send alert emails")
+		}
+		if cfg.SMTPTLS != smtpTLSStartTLS && cfg.SMTPTLS != smtpTLSImplicit && cfg.SMTPTLS != smtpTLSNone {
+			logger.Fatalf("Unsupported smtp-tls %q, supported are: starttls, tls, none", cfg.SMTPTLS)
+		}
+	}
+
+	if cfg.NotifyTimeout <= 0 {
+		logger.Fatalf("notify-timeout must be positive")
+	}
+	notifyClient.Timeout = cfg.NotifyTimeout
+
+	if cfg.AlertTemplate != "" {
+		tpl, err := template.New("alert").Parse(cfg.AlertTemplate)
+		if err != nil {
+			logger.Fatalf("Unable to parse alert-template: %s", err)
+		}
+		alertTemplate = tpl
+	}
+
+	if err := parseWebhookConfig(); err != nil {
+		logger.Fatalf("Invalid webhook configuration: %s", err)
+	}
+
+	if err := loadPagerDutyKeys(); err != nil {
+		logger.Fatalf("Unable to load PagerDuty keys: %s", err)
+	}
+
+	if ignoredStatusCodes, err = parseStatusCodes(cfg.IgnoreStatusCodes); err != nil {
+		logger.Fatalf("Invalid ignore-status-codes: %s", err)
+	}
+
+	notifiers = configuredNotifiers()
+	if notifierThresholds, err = parseNotifierThresholds(cfg.NotifierThresholds); err != nil {
+		logger.Fatalf("Invalid notifier-thresholds: %s", err)
+	}
+
+	if cfg.TriggerOnFirstFailure && len(notifierThresholds) > 0 {
+		logger.Warnf("notifier-thresholds have no effect as trigger-on-first-failure is set")
+	}
+
+	switch {
+	case cfg.Once:
+		// Single checks report through the exit code, no notifiers needed
+
+	case cfg.VerifyNotifiers && len(notifiers) == 0:
+		logger.Fatalf("You need to configure at least one notifier to verify")
+
+	case len(notifiers) == 0 && cfg.Listen == "" && cfg.HealthListen == "":
+		logger.Fatalf("You need to provide a PagerDuty service key, a Slack, Teams or Discord webhook, an OpsGenie key, an SMTP host or a webhook URL")
+
+	case len(notifiers) == 0:
+		logger.Warnf("No notifier configured, failures are only exposed through the HTTP endpoints")
+
+	case !pagerDutyConfigured():
+		logger.Warnf("No PagerDuty service key configured, alerts are only sent to the other notifiers")
+	}
+}
+
+// printVersion prints the version and, if set through ldflags, the build
+// metadata. With JSON log format the output is JSON encoded as well.
+func printVersion() {
+	if cfg.LogFormat == logFormatJSON {
+		json.NewEncoder(os.Stdout).Encode(map[string]string{
+			"version":    version,
+			"commit":     commit,
+			"build_date": buildDate,
+		})
+		return
+	}
+
+	var meta []string
+	if commit != "" {
+		meta = append(meta, "commit "+commit)
+	}
+	if buildDate != "" {
+		meta = append(meta, "built "+buildDate)
+	}
+
+	if len(meta) == 0 {
+		fmt.Printf("vault-rw-monitoring %s\n", version)
+		return
 	}
+	fmt.Printf("vault-rw-monitoring %s (%s)\n", version, strings.Join(meta, ", "))
+}
+
+// userAgent identifies the requests to Vault and the notifiers
+func userAgent() string {
+	if cfg.UserAgent != "" {
+		return cfg.UserAgent
+	}
+	return "vault-rw-monitoring/" + version
+}
+
+// clientName identifies this build in notifications
+func clientName() string {
+	if commit != "" {
+		return fmt.Sprintf("vault-rw-monitoring %s (%s)", version, commit)
+	}
+	return fmt.Sprintf("vault-rw-monitoring %s", version)
 }
 
 func main() {
-	log.Printf("vault-rw-monitoring %s started with check interval of %s and threshold of %d", version, cfg.CheckInterval, cfg.AlertThreshold)
+	configure()
 
-	for range time.Tick(cfg.CheckInterval) {
-		if err := executeTest(); err != nil {
-			currentAlertCounter++
-			log.Printf("Something went wrong, counter is now at %d / %d", currentAlertCounter, cfg.AlertThreshold)
-			log.Printf("Recorded error: %s", err)
-		} else {
-			if cfg.Verbose {
-				log.Printf("Successful test.")
+	if cfg.Describe {
+		describe()
+	}
+
+	if cfg.SendTestAlert {
+		sendTestAlert()
+	}
+
+	if cfg.VerifyNotifiers {
+		verifyNotifiers()
+	}
+
+	if cfg.AuditLog != "" {
+		startAuditLog()
+	}
+
+	if cfg.Once {
+		runOnce()
+	}
+
+	logger.Noticef("vault-rw-monitoring %s started with check interval of %s and threshold of %d", version, cfg.CheckInterval, alertThreshold())
+
+	// ctx is cancelled on shutdown to abort a running check
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Noticef("Received %s, shutting down", sig)
+		cancel()
+	}()
+
+	startHTTPServers()
+	watchPagerDutyKeys()
+	startTokenRenewal()
+	startNotificationWorker()
+	restoreState()
+
+	if cfg.CleanupOnStart {
+		cleanupOnStart()
+	}
+
+	checkCapabilities()
+
+	// The startup probe is delayed as well to not have all instances of
+	// a deploy check at the same time
+	if cfg.StartJitter > 0 {
+		delay := time.Duration(rand.Int63n(int64(cfg.StartJitter)))
+		logger.Debugf("Delaying start of checks by %s", delay)
+
+		select {
+		case <-ctx.Done():
+			// The shutdown is handled by the check loop
+		case <-time.After(delay):
+		}
+	}
+
+	if ctx.Err() == nil {
+		startupProbe(ctx)
+	}
+
+	// The ticker runs on the monotonic clock and drops ticks while the
+	// checks are running, therefore clock changes do not cause a burst of
+	// checks. In backoff mode it is reset to the delay after every run.
+	period := cfg.CheckInterval
+	ticker := time.NewTicker(period)
+
+	// Checks triggered through SIGUSR1 are executed by the loop so they
+	// never run concurrently with the scheduled checks
+	manualChecks := make(chan os.Signal, 1)
+	signal.Notify(manualChecks, syscall.SIGUSR1)
+
+	var maxRuntime <-chan time.Time
+	if cfg.MaxRuntime > 0 {
+		maxRuntime = time.After(cfg.MaxRuntime)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			ticker.Stop()
+			shutdown()
+			os.Exit(0)
+
+		case <-maxRuntime:
+			logger.Noticef("max-runtime of %s elapsed, shutting down", cfg.MaxRuntime)
+			ticker.Stop()
+			shutdown()
+			os.Exit(runSummary())
+
+		case <-manualChecks:
+			logger.Infof("Received SIGUSR1, executing check")
+			probeTargets(ctx, "Manual check")
+
+		case <-ticker.C:
+			runStart := time.Now()
+			checkTargets(ctx)
+
+			persistState()
+
+			if cfg.TokenTTLWarning > 0 && !usesVaultLogin() {
+				checkTokenTTL()
 			}
-			if err := sendPagerDutyAlert(false); err != nil {
-				log.Printf("Was not able to resolve PagerDuty alert: %s", err)
-				continue
+
+			if runDuration := time.Since(runStart); runDuration >= period {
+				// Do not start the next run right away after a run taking
+				// longer than the interval, the ticker keeps at most one of
+				// the ticks elapsed in the meantime
+				select {
+				case <-ticker.C:
+				default:
+				}
+				skipped := int(runDuration / period)
+				metricSkippedTicksTotal.Add(float64(skipped))
+				logger.Warnf("Checks took %s which is longer than the interval, skipped %d check(s)", runDuration.Round(time.Millisecond), skipped)
 			}
-		}
 
-		if currentAlertCounter >= cfg.AlertThreshold {
-			if err := sendPagerDutyAlert(true); err != nil {
-				log.Printf("Was not able to send PagerDuty alert: %s", err)
-				continue
+			if cfg.Backoff {
+				// The ticker panics on non-positive periods and a backoff
+				// must never check more often than the interval
+				period = backoffDelay()
+				if period < cfg.CheckInterval {
+					period = cfg.CheckInterval
+				}
+				if period > cfg.CheckInterval {
+					logger.Debugf("Backing off, next check in %s", period)
+				}
+				ticker.Reset(period)
 			}
 		}
 	}
+}
 
-	log.Fatalf("vault-rw-monitoring exitted unexpectedly")
+// runStats sums up the checks of the loop for the summary printed when
+// max-runtime elapsed
+var runStats checkStats
+
+type checkStats struct {
+	checks     int
+	failures   int
+	maxLatency time.Duration
 }
 
-func executeTest() error {
-	client, err := api.NewClient(&api.Config{
-		Address: cfg.VaultAddress,
-	})
+func (c *checkStats) record(duration time.Duration, err error) {
+	c.checks++
 	if err != nil {
-		return err
+		c.failures++
 	}
+	if duration > c.maxLatency {
+		c.maxLatency = duration
+	}
+}
 
-	client.SetToken(cfg.VaultToken)
+// runSummary logs the summary of all checks and returns the exit code
+func runSummary() int {
+	logger.WithFields(logFields{
+		"checks":      runStats.checks,
+		"failures":    runStats.failures,
+		"max_latency": runStats.maxLatency.String(),
+	}).Noticef("Executed %d checks with %d failures, slowest check took %s", runStats.checks, runStats.failures, runStats.maxLatency)
 
-	expectedValue := uuid.NewV4().String()
-	if _, err := client.Logical().Write(strings.TrimLeft(cfg.VaultKey, "/"), map[string]interface{}{
-		"value": expectedValue,
-	}); err != nil {
-		return fmt.Errorf("Could not write key: %s", err)
+	if cfg.MaxRuntimeFail && runStats.failures > 0 {
+		return 1
 	}
+	return 0
+}
 
-	data, err := client.Logical().Read(strings.TrimLeft(cfg.VaultKey, "/"))
-	if err != nil {
-		return fmt.Errorf("Could not read key: %s", err)
+// runOnce executes a single check for every target without alerting and
+// exits with status 1 if any of them failed
+func runOnce() {
+	exitCode := 0
+
+	for _, t := range targets {
+		start := time.Now()
+		result, err := runCheck(context.Background(), t)
+		if auditLog != nil {
+			auditLog.Record(t, start, time.Since(start), result, err)
+		}
+		if err != nil {
+			logger.Errorf("Check of %s failed: %s", t.name(), err)
+			exitCode = 1
+			continue
+		}
+
+		logger.Infof("Check of %s succeeded (%s)", t.name(), result)
 	}
 
-	if v, ok := data.Data["value"]; !ok || v.(string) != expectedValue {
-		return errors.New("Did not find expected value in key.")
+	os.Exit(exitCode)
+}
+
+// startupProbe executes one check against every target right after the
+// start, delayed only by the start-jitter, to surface a broken
+// configuration without waiting for the first interval. The probe does
+// not count towards the thresholds, with
+// fail-fast a failed probe terminates the process.
+func startupProbe(ctx context.Context) {
+	if !probeTargets(ctx, "Startup probe") && ctx.Err() == nil && cfg.FailFast {
+		logger.Fatalf("Startup probe failed and fail-fast is set, exiting")
 	}
+}
+
+// probeTargets executes a check against every target outside of the
+// alerting, logs the results including the durations of all operations
+// and reports whether all checks succeeded
+func probeTargets(ctx context.Context, name string) bool {
+	ok := true
+	for _, t := range targets {
+		result, err := runCheck(ctx, t)
+		if ctx.Err() != nil {
+			return false
+		}
+
+		probeLogger := logger.WithFields(t.logFields())
 
-	if _, err := client.Logical().Delete(strings.TrimLeft(cfg.VaultKey, "/")); err != nil {
-		return fmt.Errorf("Could not delete key: %s", err)
+		if err != nil {
+			probeLogger.WithFields(result.logFields()).WithFields(t.trace.logFields()).WithFields(logFields{
+				"error":       err,
+				"error_class": classifyError(err),
+			}).Errorf("%s of %s failed", name, t.name())
+			ok = false
+			continue
+		}
+
+		probeLogger.Infof("%s of %s succeeded (%s)", name, t.name(), result)
+	}
+	return ok
+}
+
+// checkTargets checks all targets, with concurrency of them in parallel.
+// Only the checks themselves run in parallel, their results are recorded
+// and alerted on one after another once all checks completed. Targets
+// sharing a key are checked by the same worker as concurrent writes to
+// the key through multiple nodes would fail the verification.
+func checkTargets(ctx context.Context) {
+	if cfg.Concurrency == 1 || len(targets) < 2 {
+		for _, t := range targets {
+			checkAndAlert(ctx, t)
+		}
+		return
+	}
+
+	var (
+		groups     [][]int
+		groupOfKey = map[string]int{}
+	)
+	for i, t := range targets {
+		g, ok := groupOfKey[t.key]
+		if !ok {
+			g = len(groups)
+			groupOfKey[t.key] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
 	}
 
-	return nil
+	var (
+		runs      = make([]checkRun, len(targets))
+		completed = make([]bool, len(targets))
+		jobs      = make(chan []int)
+		wg        sync.WaitGroup
+	)
+	for w := 0; w < cfg.Concurrency && w < len(groups); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range jobs {
+				for _, i := range group {
+					runs[i], completed[i] = executeCheck(ctx, targets[i])
+				}
+			}
+		}()
+	}
+	for _, group := range groups {
+		jobs <- group
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, t := range targets {
+		if completed[i] {
+			recordCheck(t, runs[i])
+		}
+	}
+}
+
+// checkRun is the outcome of a single check of a target
+type checkRun struct {
+	start    time.Time
+	duration time.Duration
+	result   checkResult
+	err      error
+	trace    *requestTrace
+}
+
+// checkAndAlert executes a single check against the target and sends out
+// alert transitions according to the result
+func checkAndAlert(ctx context.Context, t *checkTarget) {
+	if run, ok := executeCheck(ctx, t); ok {
+		recordCheck(t, run)
+	}
 }
 
-type pagerDutyEvent struct {
-	ServiceKey  string                 `json:"service_key"`
-	EventType   string                 `json:"event_type"`
-	IncidentKey string                 `json:"incident_key,omitempty"`
-	Description string                 `json:"description"`
-	Details     map[string]interface{} `json:"details,omitempty"`
-	Client      string                 `json:"client,omitempty"`
-	ClientURL   string                 `json:"client_url,omitempty"`
-	Contexts    []pagerDutyContext     `json:"contexts,omitempty"`
+// executeCheck runs the check against the target and reports false if
+// the check was aborted because the context was cancelled, these checks
+// are not to be recorded
+func executeCheck(ctx context.Context, t *checkTarget) (checkRun, bool) {
+	if ctx.Err() != nil {
+		return checkRun{}, false
+	}
+
+	metricChecksTotal.Inc(t.address, t.key, t.mode)
+	start := time.Now()
+	result, err := runCheck(ctx, t)
+	if ctx.Err() != nil {
+		// Checks aborted by the shutdown do not tell anything about Vault
+		logger.WithFields(t.logFields()).Debugf("Check was aborted for shutdown")
+		return checkRun{}, false
+	}
+
+	return checkRun{start, time.Since(start), result, err, t.trace}, true
 }
 
-type pagerDutyContext struct {
-	Type string `json:"type"`
-	Href string `json:"href,omitempty"`
-	Text string `json:"text,omitempty"`
-	Src  string `json:"src,omitempty"`
+// recordCheck records the result of a check of the target and sends out
+// alert transitions according to it
+func recordCheck(t *checkTarget, run checkRun) {
+	checkLogger := logger.WithFields(t.logFields())
+
+	checkStart, checkDuration, result, err := run.start, run.duration, run.result, run.err
+	runStats.record(checkDuration, err)
+	metricCheckDuration.Observe(checkDuration.Seconds(), t.address, t.key, t.mode)
+	t.status.RecordCheck(checkStart, checkDuration, result, err)
+	if auditLog != nil {
+		auditLog.Record(t, checkStart, checkDuration, result, err)
+	}
+
+	if err != nil {
+		t.lastError = err
+		errorClass := classifyError(err)
+		metricCheckFailuresTotal.Inc(t.address, t.key, t.mode, errorClass)
+		t.publishErrorClass(errorClass)
+		t.failureStreak++
+		if t.failureStreak == 1 {
+			t.failingSince = checkStart
+		}
+		t.successCounter = 0
+
+		t.sealInfo = nil
+		if !isConnectionError(err) {
+			t.sealInfo = querySealInfo(t.address)
+		}
+
+		failureLogger := checkLogger.WithFields(run.trace.logFields()).WithFields(logFields{
+			"error":       err,
+			"error_class": errorClass,
+		})
+		if t.sealInfo != nil {
+			failureLogger = failureLogger.WithFields(t.sealInfo.logFields())
+		}
+		if checkStart.Sub(startTime) < cfg.StartupGrace {
+			failureLogger.Warnf("Something went wrong during the startup grace period, not counting towards the threshold")
+		} else if code := vaultStatusCode(err); ignoredStatusCodes[code] {
+			failureLogger.Warnf("Vault responded with ignored status code %d, not counting towards the threshold", code)
+		} else {
+			t.alertCounter++
+			t.thresholdCounter++
+			t.publishAlertState()
+			failureLogger.WithFields(logFields{
+				"consecutive_failures": t.alertCounter,
+			}).Errorf("Something went wrong, counter is now at %d / %d", t.alertCounter, alertThreshold())
+		}
+	} else {
+		// The failures counting towards the thresholds need to be
+		// consecutive, the threshold counter is kept for an active alert
+		// until it is resolved
+		t.alertCounter = 0
+		if t.alertActive != stateFailed {
+			t.thresholdCounter = 0
+		}
+		t.publishAlertState()
+		t.failureStreak = 0
+		t.failingSince = time.Time{}
+		t.publishErrorClass("")
+		t.sealInfo = nil
+		t.successCounter++
+		t.lastSuccess = checkStart
+		checkLogger.WithFields(result.logFields()).WithFields(run.trace.logFields()).Debugf("Successful test.")
+
+		if op, d := result.Slowest(); cfg.LatencyThreshold > 0 && d > cfg.LatencyThreshold {
+			t.slowCounter++
+			metricSlowChecksTotal.Inc(t.address, t.key, t.mode)
+			checkLogger.WithFields(logFields{
+				"slow_checks": t.slowCounter,
+			}).Warnf("Check was slow, %s took %s (threshold %s)", op, d, cfg.LatencyThreshold)
+		} else {
+			t.slowCounter = 0
+		}
+
+		if t.successCounter < cfg.ResolveThreshold && t.alertActive == stateFailed {
+			checkLogger.Debugf("Successful check, counter is now at %d / %d until resolve", t.successCounter, cfg.ResolveThreshold)
+		}
+	}
+
+	maintenance, maintenanceEnd := inMaintenance(checkStart)
+
+	switch decideAlertAction(t.alertDecisionInput(err != nil), minNotifierThreshold(), cfg.ResolveThreshold) {
+	case actionTrigger:
+		if maintenance {
+			// The trigger is sent with the first failing check after the
+			// window as the counter is not reset
+			checkLogger.Warnf("Not triggering alert during maintenance window until %s", maintenanceEnd.Format(time.RFC3339))
+			break
+		}
+
+		if err := sendAlert(t, true); err != nil {
+			checkLogger.WithFields(logFields{
+				"consecutive_failures": t.alertCounter,
+			}).Errorf("Was not able to send alert: %s", err)
+		}
+
+	case actionResolve:
+		if err := sendAlert(t, false); err != nil {
+			checkLogger.Errorf("Was not able to resolve alert: %s", err)
+		}
+	}
+
+	if err != nil && !maintenance && cfg.EscalateAfter > 0 && t.alertActive == stateFailed && !t.escalated && checkStart.Sub(t.failingSince) >= cfg.EscalateAfter {
+		if err := sendEscalation(t); err != nil {
+			checkLogger.Errorf("Was not able to escalate alert: %s", err)
+			return
+		}
+		checkLogger.Warnf("Escalating alert, checks are failing since %s", t.failingSince.Format(time.RFC3339))
+	}
 }
 
-func sendPagerDutyAlert(trigger bool) error {
-	if (trigger && alertActive == stateFailed) || (!trigger && alertActive == stateOK) {
-		return nil
+// backoffDelay calculates the delay until the next check from the longest
+// failure streak of all targets: the check interval is doubled for every
+// consecutive failure, capped at backoff-max (but never below the
+// interval) and extended by up to 20% jitter. Without failures the
+// regular check interval is used.
+func backoffDelay() time.Duration {
+	var streak int
+	for _, t := range targets {
+		if t.failureStreak > streak {
+			streak = t.failureStreak
+		}
 	}
 
-	obj := pagerDutyEvent{
-		ServiceKey:  cfg.PagerDutyIntegrationKey,
-		EventType:   "trigger",
-		IncidentKey: generateIncidentKey(),
-		Description: fmt.Sprintf("Vault instance at %s failed %d consecutive tests of the vault-rw-monitoring", cfg.VaultAddress, cfg.AlertThreshold),
-		Client:      fmt.Sprintf("vault-rw-monitoring %s", version),
-		ClientURL:   clientURL,
+	if streak == 0 {
+		return cfg.CheckInterval
 	}
 
-	if !trigger {
-		obj.EventType = "resolve"
+	// A backoff-max below the interval must not speed up the checks
+	maxDelay := cfg.BackoffMax
+	if maxDelay < cfg.CheckInterval {
+		maxDelay = cfg.CheckInterval
 	}
 
-	buf := bytes.NewBuffer([]byte{})
-	if err := json.NewEncoder(buf).Encode(obj); err != nil {
-		return err
+	delay := cfg.CheckInterval
+	for i := 0; i < streak && delay < maxDelay; i++ {
+		delay *= 2
 	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if jitter := int64(delay / 5); jitter > 0 {
+		delay += time.Duration(rand.Int63n(jitter))
+	}
+
+	return delay
+}
 
-	resp, err := http.Post(eventURL, "application/json", buf)
+// cleanupOnStart removes test keys left over by a previous run which for
+// example crashed between write and delete
+func cleanupOnStart() {
+	for _, t := range targets {
+		if !deletesTestKey(t.mode) {
+			continue
+		}
+
+		client, err := getVaultClient(t.address)
+		if err != nil {
+			logger.Errorf("Could not clean up test key %s: %s", t.name(), err)
+			continue
+		}
+
+		cleaned, err := cleanupTestKey(client, t.key)
+		switch {
+		case err != nil:
+			logger.Errorf("Could not clean up test key %s: %s", t.name(), err)
+		case cleaned:
+			logger.Infof("Cleaned up left over test key %s", t.name())
+		default:
+			logger.Debugf("No left over test key %s found", t.name())
+		}
+	}
+}
+
+// shutdown removes possibly remaining test keys and, if requested,
+// resolves active alerts before the process exits. Pending notifications
+// are delivered before returning.
+func shutdown() {
+	// Operations abandoned by a cancelled check might still write the test
+	// key, their requests are cancelled but need to return first
+	inflightOps.Wait()
+
+	for _, t := range targets {
+		if deletesTestKey(t.mode) {
+			if err := shutdownCleanup(t); err != nil {
+				logger.Errorf("Could not clean up test key %s: %s", t.name(), err)
+			}
+		}
+
+		if cfg.ResolveOnExit && t.alertActive == stateFailed {
+			if err := sendAlert(t, false); err != nil {
+				logger.Errorf("Was not able to resolve alert for %s: %s", t.name(), err)
+			}
+		}
+	}
+
+	persistState()
+	stopNotificationWorker()
+}
+
+func shutdownCleanup(t *checkTarget) error {
+	client, err := getVaultClient(t.address)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("Experienced unexected status code: %d", resp.StatusCode)
+	_, err = cleanupTestKey(client, t.key)
+	return err
+}
+
+// defaultVaultKey is the default of the vault-key flag
+const defaultVaultKey = "/secret/vault-rw-monitoring"
+
+// generateIncidentKey derives the incident key from the Vault address,
+// namespace, check mode, key and tags. The default key is not folded in
+// for single-key setups and the mode only with multiple check modes to
+// keep their incident keys stable. An explicit incident-key is used as is
+// if it identifies a single target and is suffixed with the derived key
+// otherwise.
+func generateIncidentKey(address, mode, key string) string {
+	input := "vault-rw-monitoring of " + address
+	if cfg.VaultNamespace != "" {
+		input += " namespace " + cfg.VaultNamespace
+	}
+	if len(checkModes()) > 1 && mode != "" {
+		input += " mode " + mode
+	}
+	if keysPerNode() > 1 || (key != "" && key != defaultVaultKey) {
+		input += " key " + key
 	}
+	for _, k := range sortedTagKeys() {
+		input += " tag " + k + "=" + tags[k]
+	}
+	derived := fmt.Sprintf("%x", sha256.Sum256([]byte(input)))
 
-	if trigger {
-		alertActive = stateFailed
-	} else {
-		alertActive = stateOK
+	switch {
+	case cfg.IncidentKey == "":
+		return derived
+	case len(vaultAddresses()) == 1 && keysPerNode() == 1:
+		return cfg.IncidentKey
+	default:
+		return cfg.IncidentKey + "-" + derived[:12]
 	}
-	currentAlertCounter = 0
+}
+
+// parseHeaders parses a list of headers in format key=value ignoring empty
+// entries
+func parseHeaders(list []string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, h := range list {
+		if h == "" {
+			continue
+		}
 
-	return nil
+		parts := strings.SplitN(h, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Header %q is not in format key=value", h)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
 }
 
-func generateIncidentKey() string {
-	return fmt.Sprintf("%x", sha256.Sum256([]byte("vault-rw-monitoring of "+cfg.VaultAddress)))
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maintenanceUntil is the end of the maintenance window during which no
+// alerts are triggered. It is set from maintenance-until and, with
+// maintenance-endpoint, at runtime through the /maintenance endpoint of
+// the health listener.
+var (
+	maintenanceUntil time.Time
+	maintenanceLock  sync.RWMutex
+)
+
+func setMaintenanceUntil(t time.Time) {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+	maintenanceUntil = t
+}
+
+// inMaintenance reports whether the given time is within the maintenance
+// window and returns the end of the window
+func inMaintenance(t time.Time) (bool, time.Time) {
+	maintenanceLock.RLock()
+	defer maintenanceLock.RUnlock()
+	return t.Before(maintenanceUntil), maintenanceUntil
+}
+
+// maintenanceRequest is the JSON body of a POST to /maintenance
+type maintenanceRequest struct {
+	Until    string `json:"until"`
+	Duration string `json:"duration"`
+}
+
+type maintenanceResponse struct {
+	Active bool       `json:"active"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// handleMaintenance shows the maintenance window on GET, starts or extends
+// it on POST (JSON body with until as RFC3339 timestamp or duration
+// relative to now) and ends it on DELETE. Parameters are only accepted as
+// JSON body as browsers can not send those cross-site without a CORS
+// preflight.
+func handleMaintenance(res http.ResponseWriter, r *http.Request) {
+	if r.URL.RawQuery != "" {
+		http.Error(res, "Query parameters are not accepted, send a JSON body", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(res, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req maintenanceRequest
+		if err := json.NewDecoder(http.MaxBytesReader(res, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(res, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		var until time.Time
+		if req.Until != "" {
+			if t, err := time.Parse(time.RFC3339, req.Until); err == nil {
+				until = t
+			}
+		}
+		if d, err := time.ParseDuration(req.Duration); err == nil && d > 0 {
+			until = time.Now().Add(d)
+		}
+		if until.IsZero() {
+			http.Error(res, "Field until (RFC3339) or duration is required", http.StatusBadRequest)
+			return
+		}
+
+		setMaintenanceUntil(until)
+		logger.Noticef("Maintenance window set until %s", until.Format(time.RFC3339))
+
+	case http.MethodDelete:
+		setMaintenanceUntil(time.Time{})
+		logger.Noticef("Maintenance window ended")
+
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp maintenanceResponse
+	if active, until := inMaintenance(time.Now()); active {
+		resp = maintenanceResponse{Active: true, Until: &until}
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(resp)
+}
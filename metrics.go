@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Minimal implementation of the Prometheus text exposition format to
+// avoid pulling the whole client library into the vendored dependencies
+
+const (
+	metricTypeCounter   = "counter"
+	metricTypeGauge     = "gauge"
+	metricTypeHistogram = "histogram"
+)
+
+var defaultHistogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	metricChecksTotal         = newMetricVec(metricTypeCounter, "vault_rw_checks_total", "Number of executed read/write checks", "address", "key", "mode")
+	metricCheckFailuresTotal  = newMetricVec(metricTypeCounter, "vault_rw_check_failures_total", "Number of failed read/write checks", "address", "key", "mode", "class")
+	metricSlowChecksTotal     = newMetricVec(metricTypeCounter, "vault_rw_slow_checks_total", "Number of successful checks exceeding the latency threshold", "address", "key", "mode")
+	metricConsecutiveFailures = newMetricVec(metricTypeGauge, "vault_rw_consecutive_failures", "Number of consecutive failed checks", "address", "key", "mode")
+	metricAlertActive         = newMetricVec(metricTypeGauge, "vault_rw_alert_active", "Current alert state (0 = unknown, 1 = ok, 2 = failed)", "address", "key", "mode")
+	metricLastError           = newMetricVec(metricTypeGauge, "vault_rw_last_error", "Class of the error of the last check, only present while the check is failing", "address", "key", "mode", "reason")
+	metricLastTransition      = newMetricVec(metricTypeGauge, "vault_rw_last_transition_timestamp_seconds", "Time of the last alert state transition as unix timestamp", "address", "key", "mode")
+	metricCheckDuration       = newHistogramVec("vault_rw_check_duration_seconds", "Duration of the read/write check", defaultHistogramBuckets, "address", "key", "mode")
+	metricSkippedTicksTotal   = newMetricVec(metricTypeCounter, "vault_rw_skipped_ticks_total", "Number of scheduled checks skipped as the previous checks were still running")
+
+	metricPagerDutyErrorsTotal = newMetricVec(metricTypeCounter, "vault_rw_pagerduty_errors_total", "Number of error responses received from PagerDuty", "code")
+	metricNotifyTotal          = newMetricVec(metricTypeCounter, "vault_rw_notify_total", "Number of notifications sent by notifier and result (success or failure)", "notifier", "result")
+	metricNotifyDuration       = newHistogramVec("vault_rw_notify_duration_seconds", "Duration of sending a notification including retries", defaultHistogramBuckets, "notifier")
+
+	metricBuildInfo = newMetricVec(metricTypeGauge, "vault_rw_build_info", "Build information of the running vault-rw-monitoring", "version", "commit", "build_date")
+
+	exposedMetrics = []metricWriter{
+		metricBuildInfo,
+		metricChecksTotal,
+		metricCheckFailuresTotal,
+		metricSlowChecksTotal,
+		metricConsecutiveFailures,
+		metricAlertActive,
+		metricLastError,
+		metricLastTransition,
+		metricCheckDuration,
+		metricSkippedTicksTotal,
+		metricPagerDutyErrorsTotal,
+		metricNotifyTotal,
+		metricNotifyDuration,
+	}
+)
+
+type metricWriter interface {
+	writeTo(buf *bytes.Buffer)
+}
+
+type metricVec struct {
+	metricType string
+	name       string
+	help       string
+	labelNames []string
+
+	values map[string]float64
+	lock   sync.RWMutex
+}
+
+func newMetricVec(metricType, name, help string, labelNames ...string) *metricVec {
+	m := &metricVec{
+		metricType: metricType,
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     map[string]float64{},
+	}
+
+	if len(labelNames) == 0 {
+		// Metrics without labels are always exposed, even before first use
+		m.values[""] = 0
+	}
+
+	return m
+}
+
+// Add adds the given value to the metric identified by the label values
+// which need to be passed in the same order as the label names
+func (m *metricVec) Add(v float64, labelValues ...string) {
+	key := renderLabels(m.labelNames, labelValues)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[key] += v
+}
+
+// Inc increments the metric identified by the label values by one
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Set sets the metric identified by the label values to the given value
+func (m *metricVec) Set(v float64, labelValues ...string) {
+	key := renderLabels(m.labelNames, labelValues)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[key] = v
+}
+
+// Delete removes the metric identified by the label values
+func (m *metricVec) Delete(labelValues ...string) {
+	key := renderLabels(m.labelNames, labelValues)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.values, key)
+}
+
+func (m *metricVec) writeTo(buf *bytes.Buffer) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	writeMetricHeader(buf, m.name, m.help, m.metricType)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", m.name, withTags(key), formatFloat(m.values[key]))
+	}
+}
+
+type histogramValue struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type histogramVec struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+
+	values map[string]*histogramValue
+	lock   sync.RWMutex
+}
+
+func newHistogramVec(name, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		values:     map[string]*histogramValue{},
+	}
+}
+
+// Observe records the given value into the histogram identified by the
+// label values
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{buckets: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hv.buckets[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *histogramVec) writeTo(buf *bytes.Buffer) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	writeMetricHeader(buf, h.name, h.help, metricTypeHistogram)
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hv := h.values[key]
+
+		var labelValues []string
+		if len(h.labelNames) > 0 {
+			labelValues = strings.Split(key, "\xff")
+		}
+
+		bucketLabelNames := append(append([]string{}, h.labelNames...), "le")
+		for i, upper := range h.buckets {
+			labels := renderLabels(bucketLabelNames, append(append([]string{}, labelValues...), formatFloat(upper)))
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, withTags(labels), hv.buckets[i])
+		}
+		labels := renderLabels(bucketLabelNames, append(append([]string{}, labelValues...), "+Inf"))
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, withTags(labels), hv.count)
+
+		labels = withTags(renderLabels(h.labelNames, labelValues))
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, labels, formatFloat(hv.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, labels, hv.count)
+	}
+}
+
+func handleMetrics(res http.ResponseWriter, r *http.Request) {
+	buf := new(bytes.Buffer)
+	for _, m := range exposedMetrics {
+		m.writeTo(buf)
+	}
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf.WriteTo(res)
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, help, metricType string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, metricType)
+}
+
+func renderLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%s", name, strconv.Quote(value))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withTags appends the tags to the rendered labels of a series
+func withTags(labels string) string {
+	if len(tags) == 0 {
+		return labels
+	}
+
+	keys := sortedTagKeys()
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = tags[k]
+	}
+	rendered := renderLabels(keys, values)
+
+	if labels == "" {
+		return rendered
+	}
+	return labels[:len(labels)-1] + "," + rendered[1:]
+}
+
+// metricLabelNames returns the label names used by the exposed metrics
+func metricLabelNames() map[string]bool {
+	names := map[string]bool{"le": true}
+	for _, m := range exposedMetrics {
+		switch m := m.(type) {
+		case *metricVec:
+			for _, n := range m.labelNames {
+				names[n] = true
+			}
+		case *histogramVec:
+			for _, n := range m.labelNames {
+				names[n] = true
+			}
+		}
+	}
+	return names
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+var (
+	notifiers     []notifier
+	alertTemplate *template.Template
+	// notifierThresholds overrides the threshold for single notifiers
+	notifierThresholds map[string]int
+
+	// notifyClient is used for all HTTP requests of the notifiers, its
+	// timeout is set from notify-timeout
+	notifyClient = &http.Client{}
+)
+
+// notifier is implemented by every target the alert transitions are sent to
+type notifier interface {
+	// Name returns a short identifier used in logs and errors
+	Name() string
+	// Trigger notifies about the Vault instance having failed too often
+	Trigger(alertInfo) error
+	// Resolve notifies about the Vault instance being healthy again
+	Resolve(alertInfo) error
+}
+
+// escalatingNotifier is implemented by notifiers supporting to raise the
+// urgency of an already triggered alert
+type escalatingNotifier interface {
+	// Escalate notifies about the failure having persisted beyond
+	// escalate-after
+	Escalate(alertInfo) error
+}
+
+// alertKind distinguishes the outage alert from warnings about the
+// monitoring itself
+type alertKind uint
+
+const (
+	alertKindOutage alertKind = iota
+	alertKindTokenTTL
+)
+
+func (a alertKind) String() string {
+	if a == alertKindTokenTTL {
+		return "token_ttl"
+	}
+	return "outage"
+}
+
+// alertInfo contains the context of the alert passed to the notifiers
+type alertInfo struct {
+	Kind alertKind
+
+	VaultAddress string
+	CheckMode    string
+	VaultKey     string
+	IncidentKey  string
+	FailureCount int
+	Threshold    int
+	LastError    error
+	LastSuccess  time.Time
+	// NodeStates describes the state of the key on every Vault node if
+	// multiple nodes are monitored
+	NodeStates map[string]string
+	// SealInfo contains the seal status and HA leader of the node queried
+	// after the last failure, nil if unknown
+	SealInfo *sealInfo
+	// Latency summarizes the checks since the start of the incident and
+	// is only set for resolves
+	Latency *latencySummary
+	// FailingSince is the time of the first failure of the current streak
+	// and Escalated marks alerts sent because of escalate-after
+	FailingSince time.Time
+	Escalated    bool
+	// TokenTTL is the remaining TTL of the token for token TTL warnings
+	TokenTTL time.Duration
+
+	// Test marks alerts sent to verify the notifier configuration
+	Test bool
+}
+
+// logFields returns the fields identifying the target of the alert in a
+// log line
+func (a alertInfo) logFields() logFields {
+	return logFields{
+		"vault_address": a.VaultAddress,
+		"vault_key":     a.VaultKey,
+		"check_mode":    a.CheckMode,
+	}
+}
+
+// details returns the context of the alert as a map to be attached to
+// notifications supporting arbitrary details
+func (a alertInfo) details() map[string]interface{} {
+	if a.Kind == alertKindTokenTTL {
+		d := map[string]interface{}{
+			"vault_address": a.VaultAddress,
+			"token_ttl":     a.TokenTTL.String(),
+		}
+		if len(tags) > 0 {
+			d["tags"] = tags
+		}
+		return d
+	}
+
+	d := map[string]interface{}{
+		"vault_address":        a.VaultAddress,
+		"check_mode":           a.CheckMode,
+		"vault_key":            a.VaultKey,
+		"consecutive_failures": a.FailureCount,
+		"last_error":           a.errorText(),
+		"last_success":         "never",
+	}
+
+	if op := failedOperation(a.LastError); op != "" {
+		d["failed_operation"] = op
+	}
+
+	if class := classifyError(a.LastError); class != "" {
+		d["error_class"] = class
+	}
+
+	if !a.LastSuccess.IsZero() {
+		d["last_success"] = a.LastSuccess.Format(time.RFC3339)
+	}
+
+	if len(a.NodeStates) > 0 {
+		d["node_states"] = a.NodeStates
+	}
+
+	if a.SealInfo != nil {
+		for k, v := range a.SealInfo.logFields() {
+			d[k] = v
+		}
+	}
+
+	if a.Latency != nil {
+		for k, v := range a.Latency.logFields() {
+			d[k] = v
+		}
+	}
+
+	if a.Escalated {
+		d["failing_since"] = a.FailingSince.Format(time.RFC3339)
+	}
+
+	if len(tags) > 0 {
+		d["tags"] = tags
+	}
+
+	return d
+}
+
+// description renders the alert-template if configured and falls back to
+// the default wording otherwise
+func (a alertInfo) description() string {
+	if a.Kind == alertKindTokenTTL {
+		return fmt.Sprintf("Token of the vault-rw-monitoring for Vault instance at %s expires in %s", a.VaultAddress, a.TokenTTL)
+	}
+
+	if alertTemplate != nil {
+		buf := new(bytes.Buffer)
+		err := alertTemplate.Execute(buf, struct {
+			VaultAddress string
+			CheckMode    string
+			VaultKey     string
+			Threshold    int
+			FailureCount int
+			LastError    string
+		}{a.VaultAddress, a.CheckMode, a.VaultKey, a.Threshold, a.FailureCount, a.errorText()})
+		if err == nil {
+			return buf.String()
+		}
+		logger.Errorf("Unable to render alert-template, using default description: %s", err)
+	}
+
+	if keysPerNode() > 1 {
+		return fmt.Sprintf("Vault instance at %s failed %d consecutive %stests of the vault-rw-monitoring on key %s", a.VaultAddress, a.Threshold, a.modePrefix(), a.VaultKey)
+	}
+	return fmt.Sprintf("Vault instance at %s failed %d consecutive tests of the vault-rw-monitoring", a.VaultAddress, a.Threshold)
+}
+
+// title is a short summary of the trigger
+func (a alertInfo) title() string {
+	if a.Kind == alertKindTokenTTL {
+		return fmt.Sprintf("Token for Vault instance at %s expires in %s", a.VaultAddress, a.TokenTTL)
+	}
+	return a.testPrefix() + fmt.Sprintf("Vault instance at %s failed %d consecutive %stests", a.VaultAddress, a.FailureCount, a.modePrefix())
+}
+
+// resolveTitle is a short summary of the resolve
+func (a alertInfo) resolveTitle() string {
+	if a.Kind == alertKindTokenTTL {
+		return fmt.Sprintf("Token for Vault instance at %s no longer expires soon", a.VaultAddress)
+	}
+	if mode := a.modePrefix(); mode != "" {
+		return a.testPrefix() + fmt.Sprintf("Vault instance at %s recovered from failing %stests", a.VaultAddress, mode)
+	}
+	return a.testPrefix() + fmt.Sprintf("Vault instance at %s recovered", a.VaultAddress)
+}
+
+// modePrefix names the check mode in front of the tests if multiple
+// check modes are configured
+func (a alertInfo) modePrefix() string {
+	if len(checkModes()) > 1 && a.CheckMode != "" {
+		return a.CheckMode + " "
+	}
+	return ""
+}
+
+// testPrefix marks the titles of test alerts
+func (a alertInfo) testPrefix() string {
+	if a.Test {
+		return "[TEST] "
+	}
+	return ""
+}
+
+func (a alertInfo) errorText() string {
+	if a.LastError == nil {
+		return "none"
+	}
+	return a.LastError.Error()
+}
+
+// sendTestAlert triggers and resolves a test alert through every PagerDuty
+// integration key to verify the integration and exits with status 1 if
+// that failed for any of them
+func sendTestAlert() {
+	if !testNotifiers(pagerDutyNotifiers()) {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// verifyNotifiers triggers and resolves a test alert through every
+// configured notifier and exits with status 1 if any of them failed
+func verifyNotifiers() {
+	if !testNotifiers(notifiers) {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// testNotifiers sends a test trigger and its resolve through the notifiers,
+// logs the result of every notifier and reports whether all succeeded
+func testNotifiers(list []notifier) bool {
+	info := alertInfo{
+		VaultAddress: vaultAddresses()[0],
+		CheckMode:    checkModes()[0],
+		VaultKey:     cfg.VaultKey,
+		IncidentKey:  generateIncidentKey(vaultAddresses()[0], checkModes()[0], cfg.VaultKey) + "-test",
+		Threshold:    cfg.AlertThreshold,
+		FailureCount: cfg.AlertThreshold,
+		LastError:    errors.New("Test alert, no actual failure"),
+		Test:         true,
+	}
+
+	ok := true
+	for _, n := range list {
+		nLogger := logger.WithFields(logFields{"notifier": n.Name()})
+
+		if err := n.Trigger(info); err != nil {
+			nLogger.Errorf("Sending test trigger through %s failed: %s", n.Name(), err)
+			ok = false
+			continue
+		}
+		nLogger.Noticef("Test trigger was accepted by %s", n.Name())
+
+		if err := n.Resolve(info); err != nil {
+			nLogger.Errorf("Sending test resolve through %s failed: %s", n.Name(), err)
+			ok = false
+			continue
+		}
+		nLogger.Noticef("Test resolve was accepted by %s", n.Name())
+	}
+	return ok
+}
+
+// pagerDutyNotifiers creates a notifier for every integration key. With
+// multiple keys the notifiers are numbered in the order of the keys to
+// track the delivery to every service separately.
+func pagerDutyNotifiers() []notifier {
+	pagerDutyKeysLock.RLock()
+	keys := len(pagerDutyKeys)
+	pagerDutyKeysLock.RUnlock()
+
+	var n []notifier
+	for i := 0; i < keys; i++ {
+		name := "pagerduty"
+		if keys > 1 {
+			name = fmt.Sprintf("pagerduty-%d", i+1)
+		}
+
+		n = append(n, pagerDutyNotifier{
+			name:          name,
+			eventURL:      cfg.PagerDutyURL,
+			keyIndex:      i,
+			severity:      cfg.PagerDutySeverity,
+			noAutoResolve: cfg.NoAutoResolve,
+		})
+	}
+	return n
+}
+
+func configuredNotifiers() []notifier {
+	var n []notifier
+
+	n = append(n, pagerDutyNotifiers()...)
+
+	if cfg.SlackWebhook != "" {
+		n = append(n, slackNotifier{webhookURL: cfg.SlackWebhook})
+	}
+
+	if cfg.TeamsWebhook != "" {
+		n = append(n, teamsNotifier{webhookURL: cfg.TeamsWebhook})
+	}
+
+	if cfg.DiscordWebhook != "" {
+		n = append(n, discordNotifier{webhookURL: cfg.DiscordWebhook})
+	}
+
+	if cfg.OpsGenieKey != "" {
+		n = append(n, opsGenieNotifier{apiKey: cfg.OpsGenieKey, region: cfg.OpsGenieRegion})
+	}
+
+	if cfg.SMTPHost != "" {
+		n = append(n, smtpNotifier{
+			host:     cfg.SMTPHost,
+			port:     cfg.SMTPPort,
+			user:     cfg.SMTPUser,
+			password: cfg.SMTPPassword,
+			from:     cfg.SMTPFrom,
+			to:       nonEmpty(cfg.SMTPTo),
+			tlsMode:  cfg.SMTPTLS,
+		})
+	}
+
+	if cfg.WebhookURL != "" {
+		n = append(n, webhookNotifier{url: cfg.WebhookURL, template: webhookTemplate, headers: webhookHeaders})
+	}
+
+	return n
+}
+
+// parseNotifierThresholds parses the list of thresholds in format
+// name=threshold, all names must belong to configured notifiers
+func parseNotifierThresholds(list []string) (map[string]int, error) {
+	thresholds := map[string]int{}
+	for _, entry := range nonEmpty(list) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Threshold %q is not in format name=threshold", entry)
+		}
+
+		name := strings.TrimSpace(parts[0])
+		threshold, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || threshold < 1 {
+			return nil, fmt.Errorf("Threshold for %s must be a number of at least 1", name)
+		}
+
+		var configured bool
+		for _, n := range notifiers {
+			configured = configured || n.Name() == name || notifierGroup(n.Name()) == name
+		}
+		if !configured {
+			return nil, fmt.Errorf("Notifier %q is not configured", name)
+		}
+
+		thresholds[name] = threshold
+	}
+	return thresholds, nil
+}
+
+// alertThreshold returns the number of failures required to trigger the
+// notifiers without a threshold of their own
+func alertThreshold() int {
+	if cfg.TriggerOnFirstFailure {
+		return 1
+	}
+	return cfg.AlertThreshold
+}
+
+// notifierThreshold returns the number of failures required to trigger the
+// notifier
+func notifierThreshold(name string) int {
+	if cfg.TriggerOnFirstFailure {
+		return 1
+	}
+	if t, ok := notifierThresholds[name]; ok {
+		return t
+	}
+	if t, ok := notifierThresholds[notifierGroup(name)]; ok {
+		return t
+	}
+	return alertThreshold()
+}
+
+// notifierGroup strips the number from notifiers created multiple times
+// (e.g. pagerduty-2) so their threshold can be set for all of them at once
+func notifierGroup(name string) string {
+	if i := strings.LastIndex(name, "-"); i > 0 {
+		if _, err := strconv.Atoi(name[i+1:]); err == nil {
+			return name[:i]
+		}
+	}
+	return name
+}
+
+// minNotifierThreshold returns the lowest threshold of all notifiers which
+// is the threshold to trigger the alert
+func minNotifierThreshold() int {
+	min := 0
+	for _, n := range notifiers {
+		if t := notifierThreshold(n.Name()); min == 0 || t < min {
+			min = t
+		}
+	}
+	if min == 0 {
+		return alertThreshold()
+	}
+	return min
+}
+
+// nextNotifierThreshold returns the lowest notifier threshold above the
+// given counter or zero if there is none
+func nextNotifierThreshold(counter int) int {
+	next := 0
+	for _, n := range notifiers {
+		if t := notifierThreshold(n.Name()); t > counter && (next == 0 || t < next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// nodeStates describes the state of the key checked in the mode on every
+// Vault node or returns nil if only a single node is monitored
+func nodeStates(mode, key string) map[string]string {
+	if len(vaultAddresses()) < 2 {
+		return nil
+	}
+
+	states := map[string]string{}
+	for _, t := range targets {
+		if t.mode != mode || t.key != key {
+			continue
+		}
+
+		switch {
+		case t.failureStreak > 0:
+			states[t.address] = fmt.Sprintf("failing (%d consecutive failures)", t.failureStreak)
+		case t.lastSuccess.IsZero():
+			states[t.address] = "unknown"
+		default:
+			states[t.address] = "ok"
+		}
+	}
+	return states
+}
+
+// notifyQueueSize is the number of transitions buffered for the
+// notification worker before new transitions are rejected
+const notifyQueueSize = 100
+
+// notification is a transition of an alert queued for delivery
+type notification struct {
+	tracker *deliveryTracker
+	state   alarmState
+	info    alertInfo
+	// escalate marks the escalation of an already triggered alert
+	escalate bool
+}
+
+var (
+	notifyQueue = make(chan notification, notifyQueueSize)
+	notifyDone  = make(chan struct{})
+
+	// lastNotified holds the time of the last notification by notifier,
+	// incident and action, it is only accessed by the notification worker
+	lastNotified = map[string]time.Time{}
+)
+
+// sendAlert queues the transition of the target for delivery to all
+// configured notifiers without waiting for the notifiers. A transition
+// whose delivery failed is queued again on the next call for the same
+// state. If the queue is full the transition is not recorded and an error
+// is returned so it will be retried with the next check. The transition
+// from the initial unknown state to ok is recorded without notifying as no
+// alert was triggered which could be resolved.
+func sendAlert(t *checkTarget, trigger bool) error {
+	state := stateOK
+	if trigger {
+		state = stateFailed
+	}
+
+	if t.alertActive == state && t.delivery() != deliveryFailed && !(trigger && t.pendingNotifiers()) {
+		return nil
+	}
+
+	if t.alertActive != stateUnknown || trigger {
+		n := notification{
+			tracker: t.deliveryTracker,
+			state:   state,
+			info:    targetAlertInfo(t),
+		}
+		if !trigger {
+			n.info.Latency = t.incidentLatency()
+		}
+
+		if err := queueNotification(n); err != nil {
+			return err
+		}
+	}
+
+	if t.alertActive != state {
+		t.transition(state)
+	}
+	t.alertCounter = 0
+	if trigger {
+		t.notifiedThreshold = t.thresholdCounter
+		if t.incidentStart.IsZero() {
+			t.incidentStart = t.failingSince
+		}
+	} else {
+		if l := t.incidentLatency(); l != nil {
+			logger.WithFields(t.logFields()).WithFields(l.logFields()).Infof("Latency since the start of the incident: p50 %s, p95 %s, max %s", l.P50, l.P95, l.Max)
+		}
+		t.thresholdCounter = 0
+		t.notifiedThreshold = 0
+		t.incidentStart = time.Time{}
+	}
+	t.publishAlertState()
+
+	return nil
+}
+
+// sendEscalation queues the escalation of the active alert of the target
+// for the notifiers supporting it. Escalations are sent once per alert and
+// are not retried if their delivery fails.
+func sendEscalation(t *checkTarget) error {
+	info := targetAlertInfo(t)
+	info.FailureCount = t.failureStreak
+	info.FailingSince = t.failingSince
+	info.Escalated = true
+
+	n := notification{
+		// Escalations do not change the alert state therefore their
+		// delivery is tracked separately
+		tracker:  newDeliveryTracker(),
+		state:    stateFailed,
+		escalate: true,
+		info:     info,
+	}
+
+	if err := queueNotification(n); err != nil {
+		return err
+	}
+
+	t.escalated = true
+	return nil
+}
+
+func targetAlertInfo(t *checkTarget) alertInfo {
+	return alertInfo{
+		VaultAddress: t.address,
+		CheckMode:    t.mode,
+		VaultKey:     t.key,
+		IncidentKey:  generateIncidentKey(t.address, t.mode, t.key),
+		FailureCount: t.thresholdCounter,
+		Threshold:    alertThreshold(),
+		LastError:    t.lastError,
+		LastSuccess:  t.lastSuccess,
+		NodeStates:   nodeStates(t.mode, t.key),
+		SealInfo:     t.sealInfo,
+	}
+}
+
+// queueNotification hands the notification to the notification worker
+// without blocking and fails if the queue is full
+func queueNotification(n notification) error {
+	n.tracker.setDelivery(deliveryPending)
+	select {
+	case notifyQueue <- n:
+		return nil
+	default:
+		n.tracker.setDelivery(deliveryFailed)
+		return fmt.Errorf("Notification queue is full (%d entries)", notifyQueueSize)
+	}
+}
+
+// startNotificationWorker delivers the queued transitions in the order
+// they were queued
+func startNotificationWorker() {
+	go func() {
+		for n := range notifyQueue {
+			deliverNotification(n)
+		}
+		close(notifyDone)
+	}()
+}
+
+// stopNotificationWorker waits for all queued transitions to be delivered
+// and must be called from the goroutine calling sendAlert
+func stopNotificationWorker() {
+	close(notifyQueue)
+	<-notifyDone
+}
+
+// deliverNotification fans out the transition to all configured notifiers.
+// Notifiers which already received the transition are skipped so a
+// failure in one notifier does not lead to duplicate notifications in the
+// others when the delivery is retried. Notifications sent sooner than
+// min-notify-interval after an identical one are suppressed and, like
+// failed deliveries, retried with the next check.
+func deliverNotification(n notification) {
+	d := n.tracker
+	action := n.action()
+
+	var (
+		result     *multierror.Error
+		suppressed bool
+	)
+	for _, nf := range notifiers {
+		if d.notifierStates[nf.Name()] == n.state {
+			continue
+		}
+
+		info := n.info
+		if info.Kind == alertKindOutage {
+			info.Threshold = notifierThreshold(nf.Name())
+		}
+
+		if n.state == stateFailed && info.Kind == alertKindOutage && info.FailureCount < info.Threshold {
+			// The notifier is triggered with a later check, until then
+			// it must not receive the resolve either
+			if !n.escalate {
+				d.notifierStates[nf.Name()] = stateOK
+			}
+			continue
+		}
+
+		if n.escalate {
+			if _, ok := nf.(escalatingNotifier); !ok {
+				continue
+			}
+		}
+
+		rateKey := strings.Join([]string{nf.Name(), info.IncidentKey, action}, "|")
+		if last, ok := lastNotified[rateKey]; ok && cfg.MinNotifyInterval > 0 && time.Since(last) < cfg.MinNotifyInterval {
+			logger.WithFields(info.logFields()).WithFields(logFields{
+				"notifier": nf.Name(),
+			}).Warnf("Suppressed %s, the last one was sent %s ago", action, time.Since(last).Round(time.Second))
+			suppressed = true
+			continue
+		}
+
+		var err error
+		start := time.Now()
+		if n.escalate {
+			err = nf.(escalatingNotifier).Escalate(info)
+		} else if n.state == stateFailed {
+			err = nf.Trigger(info)
+		} else {
+			err = nf.Resolve(info)
+		}
+		metricNotifyDuration.Observe(time.Since(start).Seconds(), nf.Name())
+
+		if err != nil {
+			metricNotifyTotal.Inc(nf.Name(), "failure")
+			result = multierror.Append(result, fmt.Errorf("%s: %s", nf.Name(), err))
+			continue
+		}
+
+		metricNotifyTotal.Inc(nf.Name(), "success")
+		d.notifierStates[nf.Name()] = n.state
+		lastNotified[rateKey] = time.Now()
+	}
+
+	if err := result.ErrorOrNil(); err != nil {
+		d.setDelivery(deliveryFailed)
+		logger.WithFields(n.info.logFields()).Errorf("Was not able to deliver %s: %s", action, err)
+		return
+	}
+
+	if suppressed {
+		d.setDelivery(deliveryFailed)
+		return
+	}
+
+	d.setDelivery(deliveryDone)
+}
+
+// action names the kind of the notification in logs
+func (n notification) action() string {
+	switch {
+	case n.escalate:
+		return "escalation"
+	case n.state == stateFailed:
+		return "trigger"
+	default:
+		return "resolve"
+	}
+}
+
+// postJSON sends the JSON encoded body to the given URL and fails on
+// status codes indicating an error
+func postJSON(url string, headers map[string]string, body interface{}) error {
+	buf := bytes.NewBuffer([]byte{})
+	if err := json.NewEncoder(buf).Encode(body); err != nil {
+		return err
+	}
+
+	return postRawJSON(url, headers, buf.Bytes())
+}
+
+// postRawJSON sends the already encoded JSON body to the given URL and
+// fails on status codes indicating an error
+func postRawJSON(url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return statusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	return nil
+}
+
+// statusError is returned by postRawJSON for status codes indicating an
+// error so callers are able to handle the classes differently
+type statusError struct {
+	StatusCode int
+	// RetryAfter is the delay requested by the server or zero if it did
+	// not send a (valid) Retry-After header
+	RetryAfter time.Duration
+}
+
+func (s statusError) Error() string {
+	return fmt.Sprintf("Experienced unexected status code: %d", s.StatusCode)
+}
+
+// parseRetryAfter supports both the delay-seconds and the HTTP-date format
+// of the Retry-After header
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil && time.Until(t) > 0 {
+		return time.Until(t)
+	}
+
+	return 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	// discordRetries is the number of retries for rate limited messages
+	discordRetries = 2
+	// discordMaxRetryAfter caps the delay requested by Discord
+	discordMaxRetryAfter = 10 * time.Second
+	// discordMaxFieldLength is the limit Discord enforces for field values
+	discordMaxFieldLength = 1024
+)
+
+// discordMessage is the body of a Discord webhook execution, colors of
+// the embeds are given as decimal RGB values
+type discordMessage struct {
+	Username string         `json:"username,omitempty"`
+	Embeds   []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	Color       int                 `json:"color"`
+	Fields      []discordEmbedField `json:"fields"`
+	Timestamp   string              `json:"timestamp"`
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
+}
+
+type discordNotifier struct {
+	webhookURL string
+}
+
+func (d discordNotifier) Name() string { return "discord" }
+
+func (d discordNotifier) Trigger(info alertInfo) error {
+	color := 0xD63333
+	if info.Kind != alertKindOutage {
+		color = 0xE8A317
+	}
+	return d.send(color, info.title(), info.description(), info)
+}
+
+func (d discordNotifier) Resolve(info alertInfo) error {
+	return d.send(0x2EB886, info.resolveTitle(), "", info)
+}
+
+func (d discordNotifier) send(color int, title, text string, info alertInfo) error {
+	fields := []discordEmbedField{
+		{Name: "Vault address", Value: info.VaultAddress, Inline: true},
+		{Name: "Vault key", Value: info.VaultKey, Inline: true},
+		{Name: "Consecutive failures", Value: strconv.Itoa(info.FailureCount), Inline: true},
+		{Name: "Last error", Value: truncate(info.errorText(), discordMaxFieldLength)},
+	}
+	if info.Kind == alertKindTokenTTL {
+		fields = []discordEmbedField{
+			{Name: "Vault address", Value: info.VaultAddress, Inline: true},
+			{Name: "Token TTL", Value: info.TokenTTL.String(), Inline: true},
+		}
+	}
+	for _, k := range sortedTagKeys() {
+		fields = append(fields, discordEmbedField{Name: k, Value: tags[k], Inline: true})
+	}
+
+	msg := discordMessage{
+		Username: "vault-rw-monitoring",
+		Embeds: []discordEmbed{{
+			Title:       title,
+			Description: text,
+			Color:       color,
+			Fields:      fields,
+			Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		}},
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := postJSON(d.webhookURL, nil, msg)
+
+		var sErr statusError
+		if !errors.As(err, &sErr) || sErr.StatusCode != 429 || attempt >= discordRetries {
+			return err
+		}
+
+		wait := sErr.RetryAfter
+		if wait <= 0 {
+			wait = time.Second
+		}
+		if wait > discordMaxRetryAfter {
+			wait = discordMaxRetryAfter
+		}
+
+		logger.Warnf("Discord rate limited the message, retrying in %s (attempt %d/%d)", wait, attempt+1, discordRetries+1)
+		time.Sleep(wait)
+	}
+}
+
+// truncate shortens the text to at most max characters, marking the cut.
+// Discord counts characters, cutting bytes could split a multi-byte rune.
+func truncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max-3]) + "..."
+}
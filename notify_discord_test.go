@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"longer than ten", 10, "longer ..."},
+		{"äöüäöüäöüä", 10, "äöüäöüäöüä"},
+		{"äöüäöüäöüäö", 10, "äöüäöüä..."},
+	} {
+		got := truncate(tc.text, tc.max)
+		if got != tc.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tc.text, tc.max, got, tc.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) returned invalid UTF-8 %q", tc.text, tc.max, got)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+var opsGenieAPIURLs = map[string]string{
+	"us": "https://api.opsgenie.com",
+	"eu": "https://api.eu.opsgenie.com",
+}
+
+type opsGenieAlert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	Priority    string            `json:"priority,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+}
+
+type opsGenieClose struct {
+	Source string `json:"source,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+type opsGenieNotifier struct {
+	apiKey string
+	region string
+}
+
+func (o opsGenieNotifier) Name() string { return "opsgenie" }
+
+func (o opsGenieNotifier) Trigger(info alertInfo) error {
+	if info.Kind == alertKindTokenTTL {
+		return o.send("/v2/alerts", opsGenieAlert{
+			Message:     info.title(),
+			Alias:       info.IncidentKey,
+			Description: info.description(),
+			Details: map[string]string{
+				"vault_address": info.VaultAddress,
+				"token_ttl":     info.TokenTTL.String(),
+			},
+			Source:   clientName(),
+			Priority: "P4",
+			Tags:     opsGenieTags(),
+		})
+	}
+
+	return o.send("/v2/alerts", opsGenieAlert{
+		Message:     info.title(),
+		Alias:       info.IncidentKey,
+		Description: fmt.Sprintf("Vault instance at %s failed %d consecutive tests of the vault-rw-monitoring on key %s", info.VaultAddress, info.FailureCount, info.VaultKey),
+		Details: map[string]string{
+			"vault_address":        info.VaultAddress,
+			"check_mode":           info.CheckMode,
+			"vault_key":            info.VaultKey,
+			"consecutive_failures": strconv.Itoa(info.FailureCount),
+			"last_error":           info.errorText(),
+		},
+		Source:   clientName(),
+		Priority: "P1",
+		Tags:     opsGenieTags(),
+	})
+}
+
+func (o opsGenieNotifier) Resolve(info alertInfo) error {
+	path := fmt.Sprintf("/v2/alerts/%s/close?identifierType=alias", url.PathEscape(info.IncidentKey))
+	return o.send(path, opsGenieClose{
+		Source: clientName(),
+		Note:   info.resolveTitle(),
+	})
+}
+
+// opsGenieTags renders the tags in the key:value notation common for
+// OpsGenie tags
+func opsGenieTags() []string {
+	var t []string
+	for _, k := range sortedTagKeys() {
+		t = append(t, k+":"+tags[k])
+	}
+	return t
+}
+
+func (o opsGenieNotifier) send(path string, body interface{}) error {
+	return postJSON(opsGenieAPIURLs[o.region]+path, map[string]string{
+		"Authorization": "GenieKey " + o.apiKey,
+	}, body)
+}
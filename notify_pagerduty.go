@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const clientURL = "https://github.com/Jimdo/vault-rw-monitoring"
+
+const (
+	// pagerDutyRetries is the number of retries for rate limited events and
+	// server errors before giving up
+	pagerDutyRetries = 3
+	// pagerDutyMaxRetryAfter caps the delay requested by PagerDuty to not
+	// stall the checks for too long
+	pagerDutyMaxRetryAfter = 30 * time.Second
+)
+
+var pagerDutySeverities = []string{"critical", "error", "warning", "info"}
+
+// pagerDutySeverityMap overrides the pagerduty-severity per error class
+var pagerDutySeverityMap map[string]string
+
+// parseSeverityMap parses the list of severities in format class=severity
+func parseSeverityMap(list []string) (map[string]string, error) {
+	severities := map[string]string{}
+	for _, entry := range nonEmpty(list) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Severity %q is not in format class=severity", entry)
+		}
+
+		class, severity := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch {
+		case !stringInSlice(class, errorClasses):
+			return nil, fmt.Errorf("Unsupported error class %q, supported are: %s", class, strings.Join(errorClasses, ", "))
+		case !stringInSlice(severity, pagerDutySeverities):
+			return nil, fmt.Errorf("Unsupported severity %q, supported are: %s", severity, strings.Join(pagerDutySeverities, ", "))
+		}
+
+		severities[class] = severity
+	}
+	return severities, nil
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key,omitempty"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+	Client      string            `json:"client,omitempty"`
+	ClientURL   string            `json:"client_url,omitempty"`
+	Links       []pagerDutyLink   `json:"links,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+type pagerDutyLink struct {
+	Href string `json:"href"`
+	Text string `json:"text,omitempty"`
+}
+
+type pagerDutyNotifier struct {
+	// name is numbered when multiple integration keys are configured
+	name     string
+	eventURL string
+	// keyIndex refers to the integration key in pagerDutyKeys
+	keyIndex int
+	severity string
+	// noAutoResolve leaves resolving the incidents to a human
+	noAutoResolve bool
+}
+
+func (p pagerDutyNotifier) Name() string { return p.name }
+
+func (p pagerDutyNotifier) Trigger(info alertInfo) error {
+	return p.send("trigger", info)
+}
+
+func (p pagerDutyNotifier) Resolve(info alertInfo) error {
+	if p.noAutoResolve && !info.Test {
+		logger.Debugf("Not resolving PagerDuty incident %s as no-auto-resolve is set", info.IncidentKey)
+		return nil
+	}
+	return p.send("resolve", info)
+}
+
+// Escalate triggers the alert once more with the critical severity which
+// updates the existing incident through the dedup key
+func (p pagerDutyNotifier) Escalate(info alertInfo) error {
+	return p.send("trigger", info)
+}
+
+func (p pagerDutyNotifier) send(eventAction string, info alertInfo) error {
+	summary := info.description()
+	if info.Test {
+		summary = fmt.Sprintf("[TEST] Test alert of the vault-rw-monitoring for Vault instance at %s, no action required", info.VaultAddress)
+	}
+
+	severity := p.severity
+	if s, ok := pagerDutySeverityMap[classifyError(info.LastError)]; ok {
+		severity = s
+	}
+
+	switch {
+	case info.Kind == alertKindTokenTTL:
+		severity = "warning"
+	case info.Escalated:
+		severity = "critical"
+		summary = fmt.Sprintf("[ESCALATED] %s, failing since %s", summary, info.FailingSince.Format(time.RFC3339))
+	}
+
+	obj := pagerDutyEvent{
+		RoutingKey:  pagerDutyKey(p.keyIndex),
+		EventAction: eventAction,
+		DedupKey:    info.IncidentKey,
+		Payload: &pagerDutyPayload{
+			Summary:       summary,
+			Source:        info.VaultAddress,
+			Severity:      severity,
+			CustomDetails: info.details(),
+		},
+		Client:    clientName(),
+		ClientURL: clientURL,
+	}
+
+	if cfg.ExternalURL != "" {
+		statusPage := strings.TrimRight(cfg.ExternalURL, "/") + "/"
+		obj.ClientURL = statusPage
+		obj.Links = []pagerDutyLink{{Href: statusPage, Text: "vault-rw-monitoring status page"}}
+	}
+
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := postJSON(p.eventURL, nil, obj)
+
+		var sErr statusError
+		if !errors.As(err, &sErr) {
+			return err
+		}
+		metricPagerDutyErrorsTotal.Inc(strconv.Itoa(sErr.StatusCode))
+
+		switch {
+		case sErr.StatusCode == 429:
+			err = fmt.Errorf("PagerDuty rate limited the event: %w", err)
+		case sErr.StatusCode >= 500:
+			err = fmt.Errorf("PagerDuty failed to process the event: %w", err)
+		default:
+			// Any other status means the event was rejected, retrying the
+			// same event will not help
+			return fmt.Errorf("PagerDuty rejected the event: %w", err)
+		}
+
+		if attempt >= pagerDutyRetries {
+			return err
+		}
+
+		wait := delay
+		if sErr.RetryAfter > 0 {
+			wait = sErr.RetryAfter
+		}
+		if wait > pagerDutyMaxRetryAfter {
+			wait = pagerDutyMaxRetryAfter
+		}
+
+		logger.Warnf("%s, retrying in %s (attempt %d/%d)", err, wait, attempt+1, pagerDutyRetries+1)
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strconv"
+)
+
+type slackMessage struct {
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Title    string       `json:"title"`
+	Fields   []slackField `json:"fields"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type slackNotifier struct {
+	webhookURL string
+}
+
+func (s slackNotifier) Name() string { return "slack" }
+
+func (s slackNotifier) Trigger(info alertInfo) error {
+	color := "danger"
+	if info.Kind != alertKindOutage {
+		color = "warning"
+	}
+	return s.send(color, info.title(), info)
+}
+
+func (s slackNotifier) Resolve(info alertInfo) error {
+	return s.send("good", info.resolveTitle(), info)
+}
+
+func (s slackNotifier) send(color, title string, info alertInfo) error {
+	fields := []slackField{
+		{Title: "Vault address", Value: info.VaultAddress, Short: true},
+		{Title: "Vault key", Value: info.VaultKey, Short: true},
+		{Title: "Consecutive failures", Value: strconv.Itoa(info.FailureCount), Short: true},
+		{Title: "Last error", Value: info.errorText()},
+	}
+	if info.Kind == alertKindTokenTTL {
+		fields = []slackField{
+			{Title: "Vault address", Value: info.VaultAddress, Short: true},
+			{Title: "Token TTL", Value: info.TokenTTL.String(), Short: true},
+		}
+	}
+	for _, k := range sortedTagKeys() {
+		fields = append(fields, slackField{Title: k, Value: tags[k], Short: true})
+	}
+
+	msg := slackMessage{
+		Attachments: []slackAttachment{{
+			Fallback: title,
+			Color:    color,
+			Title:    title,
+			Fields:   fields,
+		}},
+	}
+
+	return postJSON(s.webhookURL, nil, msg)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	smtpTLSStartTLS = "starttls"
+	smtpTLSImplicit = "tls"
+	smtpTLSNone     = "none"
+)
+
+type smtpNotifier struct {
+	host     string
+	port     int
+	user     string
+	password string
+	from     string
+	to       []string
+	tlsMode  string
+}
+
+func (s smtpNotifier) Name() string { return "smtp" }
+
+func (s smtpNotifier) Trigger(info alertInfo) error {
+	return s.send(info.title(), info.description(), info)
+}
+
+func (s smtpNotifier) Resolve(info alertInfo) error {
+	return s.send(info.resolveTitle(), "", info)
+}
+
+func (s smtpNotifier) send(subject, text string, info alertInfo) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(s.host, strconv.Itoa(s.port)), cfg.NotifyTimeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(cfg.NotifyTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	tlsConfig := &tls.Config{ServerName: s.host}
+	if s.tlsMode == smtpTLSImplicit {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.tlsMode == smtpTLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("Server does not support STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if s.user != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.user, s.password, s.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	for _, rcpt := range s.to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(s.message(subject, text, info)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// message renders the mail including its headers, the body lists the
+// details of the alert below the description
+func (s smtpNotifier) message(subject, text string, info alertInfo) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", s.from)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	if text != "" {
+		fmt.Fprintf(buf, "%s\r\n\r\n", text)
+	}
+
+	details := info.details()
+	var keys []string
+	for k := range details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(buf, "%s: %v\r\n", k, details[k])
+	}
+
+	return buf.Bytes()
+}
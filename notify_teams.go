@@ -0,0 +1,72 @@
+package main
+
+import "strconv"
+
+// teamsMessageCard is the legacy actionable message card format accepted
+// by Microsoft Teams incoming webhooks
+type teamsMessageCard struct {
+	Type       string         `json:"@type"`
+	Context    string         `json:"@context"`
+	Summary    string         `json:"summary"`
+	ThemeColor string         `json:"themeColor"`
+	Title      string         `json:"title"`
+	Sections   []teamsSection `json:"sections"`
+}
+
+type teamsSection struct {
+	Text  string      `json:"text,omitempty"`
+	Facts []teamsFact `json:"facts"`
+}
+
+type teamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type teamsNotifier struct {
+	webhookURL string
+}
+
+func (t teamsNotifier) Name() string { return "teams" }
+
+func (t teamsNotifier) Trigger(info alertInfo) error {
+	color := "D63333"
+	if info.Kind != alertKindOutage {
+		color = "E8A317"
+	}
+	return t.send(color, info.title(), info.description(), info)
+}
+
+func (t teamsNotifier) Resolve(info alertInfo) error {
+	return t.send("2EB886", info.resolveTitle(), "", info)
+}
+
+func (t teamsNotifier) send(color, title, text string, info alertInfo) error {
+	facts := []teamsFact{
+		{Name: "Vault address", Value: info.VaultAddress},
+		{Name: "Vault key", Value: info.VaultKey},
+		{Name: "Consecutive failures", Value: strconv.Itoa(info.FailureCount)},
+		{Name: "Last error", Value: info.errorText()},
+	}
+	if info.Kind == alertKindTokenTTL {
+		facts = []teamsFact{
+			{Name: "Vault address", Value: info.VaultAddress},
+			{Name: "Token TTL", Value: info.TokenTTL.String()},
+		}
+	}
+	for _, k := range sortedTagKeys() {
+		facts = append(facts, teamsFact{Name: k, Value: tags[k]})
+	}
+
+	return postJSON(t.webhookURL, nil, teamsMessageCard{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		Summary:    title,
+		ThemeColor: color,
+		Title:      title,
+		Sections: []teamsSection{{
+			Text:  text,
+			Facts: facts,
+		}},
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+// TestSendAlertColdStart verifies the first success after the start does
+// not send a resolve while triggers and later resolves are still sent
+func TestSendAlertColdStart(t *testing.T) {
+	drainNotifyQueue()
+	defer drainNotifyQueue()
+
+	target := newCheckTarget("http://127.0.0.1:8200", checkModeKV, "cold-start")
+
+	if err := sendAlert(target, false); err != nil {
+		t.Fatalf("resolve from unknown: %s", err)
+	}
+	if n := len(notifyQueue); n != 0 {
+		t.Fatalf("resolve from unknown queued %d notifications, want none", n)
+	}
+	if target.alertActive != stateOK {
+		t.Fatalf("state after success from unknown is %s, want ok", target.alertActive)
+	}
+
+	target = newCheckTarget("http://127.0.0.1:8200", checkModeKV, "cold-start-failure")
+
+	if err := sendAlert(target, true); err != nil {
+		t.Fatalf("trigger from unknown: %s", err)
+	}
+	if n := len(notifyQueue); n != 1 {
+		t.Fatalf("trigger from unknown queued %d notifications, want 1", n)
+	}
+	if n := <-notifyQueue; n.state != stateFailed {
+		t.Fatalf("trigger from unknown queued state %s, want failed", n.state)
+	}
+
+	if err := sendAlert(target, false); err != nil {
+		t.Fatalf("resolve from failed: %s", err)
+	}
+	if n := len(notifyQueue); n != 1 {
+		t.Fatalf("resolve from failed queued %d notifications, want 1", n)
+	}
+	if n := <-notifyQueue; n.state != stateOK {
+		t.Fatalf("resolve from failed queued state %s, want ok", n.state)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/template"
+)
+
+const defaultWebhookTemplate = `{
+  "state": {{ json .State }},
+  "kind": {{ json .Kind }},
+  "vault_address": {{ json .VaultAddress }},
+  "check_mode": {{ json .CheckMode }},
+  "vault_key": {{ json .VaultKey }},
+  "incident_key": {{ json .IncidentKey }},
+  "threshold": {{ .Threshold }},
+  "failure_count": {{ .FailureCount }},
+  "last_error": {{ json .LastError }},
+  "tags": {{ json .Tags }}
+}`
+
+var (
+	webhookTemplate *template.Template
+	webhookHeaders  map[string]string
+)
+
+type webhookData struct {
+	State        string
+	Kind         string
+	VaultAddress string
+	CheckMode    string
+	VaultKey     string
+	IncidentKey  string
+	Threshold    int
+	FailureCount int
+	LastError    string
+	Tags         map[string]string
+}
+
+type webhookNotifier struct {
+	url      string
+	template *template.Template
+	headers  map[string]string
+}
+
+// parseWebhookConfig parses the body template and the headers of the
+// generic webhook notifier
+func parseWebhookConfig() error {
+	tplSource := cfg.WebhookTemplate
+	if tplSource == "" {
+		tplSource = defaultWebhookTemplate
+	}
+
+	tpl, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(tplSource)
+	if err != nil {
+		return fmt.Errorf("Unable to parse webhook-template: %s", err)
+	}
+	webhookTemplate = tpl
+
+	webhookHeaders, err = parseHeaders(cfg.WebhookHeaders)
+	return err
+}
+
+func (w webhookNotifier) Name() string { return "webhook" }
+
+func (w webhookNotifier) Trigger(info alertInfo) error {
+	return w.send("trigger", info)
+}
+
+func (w webhookNotifier) Resolve(info alertInfo) error {
+	return w.send("resolve", info)
+}
+
+func (w webhookNotifier) send(state string, info alertInfo) error {
+	buf := new(bytes.Buffer)
+	if err := w.template.Execute(buf, webhookData{
+		State:        state,
+		Kind:         info.Kind.String(),
+		VaultAddress: info.VaultAddress,
+		CheckMode:    info.CheckMode,
+		VaultKey:     info.VaultKey,
+		IncidentKey:  info.IncidentKey,
+		Threshold:    info.Threshold,
+		FailureCount: info.FailureCount,
+		LastError:    info.errorText(),
+		Tags:         tags,
+	}); err != nil {
+		return fmt.Errorf("Unable to render webhook-template: %s", err)
+	}
+
+	if !json.Valid(buf.Bytes()) {
+		return errors.New("Rendered webhook-template is no valid JSON")
+	}
+
+	return postRawJSON(w.url, w.headers, buf.Bytes())
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// vaultKeyPrefix marks integration keys to be read from Vault, the key is
+// given as vault://path#field
+const vaultKeyPrefix = "vault://"
+
+// pagerDutyKeys are the resolved integration keys, the PagerDuty notifiers
+// refer to them by index so the keys can be rotated on SIGHUP
+var (
+	pagerDutyKeys     []string
+	pagerDutyKeysLock sync.RWMutex
+)
+
+// pagerDutyConfigured reports whether any integration key source is set
+func pagerDutyConfigured() bool {
+	return len(nonEmpty(cfg.PagerDutyIntegrationKeys)) > 0 || cfg.PagerDutyKeyFile != ""
+}
+
+// pagerDutyKey returns the current integration key with the given index
+func pagerDutyKey(i int) string {
+	pagerDutyKeysLock.RLock()
+	defer pagerDutyKeysLock.RUnlock()
+	return pagerDutyKeys[i]
+}
+
+// loadPagerDutyKeys resolves the integration keys from pagerduty-key and
+// pagerduty-key-file, entries in format vault://path#field are read from
+// Vault
+func loadPagerDutyKeys() error {
+	keys := nonEmpty(cfg.PagerDutyIntegrationKeys)
+
+	if cfg.PagerDutyKeyFile != "" {
+		raw, err := ioutil.ReadFile(cfg.PagerDutyKeyFile)
+		if err != nil {
+			return fmt.Errorf("Could not read key file: %s", err)
+		}
+		fileKeys := nonEmpty(strings.FieldsFunc(string(raw), func(r rune) bool { return r == '\n' || r == ',' }))
+		if len(fileKeys) == 0 {
+			return fmt.Errorf("Key file is empty")
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	for i, key := range keys {
+		if !strings.HasPrefix(key, vaultKeyPrefix) {
+			continue
+		}
+
+		value, err := readVaultField(strings.TrimPrefix(key, vaultKeyPrefix))
+		if err != nil {
+			return err
+		}
+		keys[i] = value
+	}
+
+	pagerDutyKeysLock.Lock()
+	defer pagerDutyKeysLock.Unlock()
+
+	if pagerDutyKeys != nil && len(keys) != len(pagerDutyKeys) {
+		return fmt.Errorf("Number of keys changed from %d to %d, a restart is required", len(pagerDutyKeys), len(keys))
+	}
+	pagerDutyKeys = keys
+	return nil
+}
+
+// readVaultField reads a field of the secret at the API path given in
+// format path#field from the first Vault node
+func readVaultField(ref string) (string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("Key %s%s is not in format %spath#field", vaultKeyPrefix, ref, vaultKeyPrefix)
+	}
+
+	client, err := getVaultClient(vaultAddresses()[0])
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := client.Logical().Read(strings.TrimLeft(parts[0], "/"))
+	if err != nil {
+		return "", fmt.Errorf("Could not read key from Vault: %s", err)
+	}
+
+	// Secrets of KV version 2 nest the fields in a data field
+	value, ok := secretString(secret, parts[1])
+	if !ok && secret != nil {
+		if data, isMap := secret.Data["data"].(map[string]interface{}); isMap {
+			value, ok = data[parts[1]].(string)
+		}
+	}
+	if !ok || value == "" {
+		return "", fmt.Errorf("Did not find field %s in %s", parts[1], parts[0])
+	}
+	return value, nil
+}
+
+// watchPagerDutyKeys reloads the integration keys on every SIGHUP if they
+// are read from a file or Vault
+func watchPagerDutyKeys() {
+	if cfg.PagerDutyKeyFile == "" && !strings.Contains(strings.Join(cfg.PagerDutyIntegrationKeys, ","), vaultKeyPrefix) {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := loadPagerDutyKeys(); err != nil {
+				logger.Errorf("Unable to reload PagerDuty keys, keeping the previous ones: %s", err)
+				continue
+			}
+			logger.Infof("Reloaded PagerDuty keys")
+		}
+	}()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// stateStore persists the alert state of the targets across restarts
+type stateStore interface {
+	// Load returns the stored states, a missing store is no error
+	Load() (map[string]persistedTarget, error)
+	Save(map[string]persistedTarget) error
+}
+
+// persistedTarget is the part of the state of a target needed to continue
+// an incident after a restart
+type persistedTarget struct {
+	AlertState        string    `json:"alert_state"`
+	StateSince        time.Time `json:"state_since"`
+	AlertCounter      int       `json:"alert_counter"`
+	ThresholdCounter  int       `json:"threshold_counter"`
+	NotifiedThreshold int       `json:"notified_threshold"`
+	FailureStreak     int       `json:"failure_streak"`
+	FailingSince      time.Time `json:"failing_since"`
+	IncidentStart     time.Time `json:"incident_start"`
+}
+
+var (
+	stateStorage stateStore
+	// savedState is the content of the last save to skip unchanged writes
+	savedState map[string]persistedTarget
+)
+
+// fileStateStore keeps the states as JSON in a file which is replaced
+// atomically on every save
+type fileStateStore struct {
+	path string
+}
+
+func (f fileStateStore) Load() (map[string]persistedTarget, error) {
+	raw, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	states := map[string]persistedTarget{}
+	return states, json.Unmarshal(raw, &states)
+}
+
+func (f fileStateStore) Save(states map[string]persistedTarget) error {
+	raw, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The temporary file is created next to the state file as the rename
+	// is only atomic within the same filesystem
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), "."+filepath.Base(f.path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// stateID identifies the target in the state store independent of the
+// tags and incident-key which might change between restarts
+func (t *checkTarget) stateID() string {
+	return strings.Join([]string{t.address, t.mode, t.key}, " ")
+}
+
+// restoreState loads the alert state of the targets stored by a previous
+// run. A broken store is logged and the targets start in unknown state.
+func restoreState() {
+	if stateStorage == nil {
+		return
+	}
+
+	states, err := stateStorage.Load()
+	if err != nil {
+		logger.Errorf("Unable to load state-file, starting without previous state: %s", err)
+		return
+	}
+
+	for _, t := range targets {
+		s, ok := states[t.stateID()]
+		if !ok {
+			continue
+		}
+
+		for _, state := range []alarmState{stateOK, stateFailed} {
+			if s.AlertState == state.String() {
+				t.alertActive = state
+			}
+		}
+		t.stateSince = s.StateSince
+		t.alertCounter = s.AlertCounter
+		t.thresholdCounter = s.ThresholdCounter
+		t.notifiedThreshold = s.NotifiedThreshold
+		t.failureStreak = s.FailureStreak
+		t.failingSince = s.FailingSince
+		t.incidentStart = s.IncidentStart
+		t.publishAlertState()
+
+		logger.WithFields(t.logFields()).Infof("Restored alert state %s of %s (%d consecutive failures)", t.alertActive, t.name(), t.alertCounter)
+	}
+
+	savedState = states
+}
+
+// persistState stores the alert state of all targets if it changed since
+// the last save
+func persistState() {
+	if stateStorage == nil {
+		return
+	}
+
+	states := map[string]persistedTarget{}
+	for _, t := range targets {
+		states[t.stateID()] = persistedTarget{
+			AlertState:        t.alertActive.String(),
+			StateSince:        t.stateSince,
+			AlertCounter:      t.alertCounter,
+			ThresholdCounter:  t.thresholdCounter,
+			NotifiedThreshold: t.notifiedThreshold,
+			FailureStreak:     t.failureStreak,
+			FailingSince:      t.failingSince,
+			IncidentStart:     t.incidentStart,
+		}
+	}
+
+	if reflect.DeepEqual(states, savedState) {
+		return
+	}
+
+	if err := stateStorage.Save(states); err != nil {
+		logger.Errorf("Unable to write state-file: %s", err)
+		return
+	}
+	savedState = states
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+)
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>vault-rw-monitoring</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #333; }
+table { border-collapse: collapse; }
+th, td { padding: .4em .8em; text-align: left; border-bottom: 1px solid #ddd; }
+.state { color: #fff; font-weight: bold; }
+.ok { background: #2eb886; }
+.failed { background: #d63333; }
+.unknown { background: #999; }
+</style>
+</head>
+<body>
+<h1>vault-rw-monitoring</h1>
+<p>Version {{ .Version }}, up for {{ .Uptime }}</p>
+<table>
+<tr><th>Target</th><th>State</th><th>Consecutive failures</th><th>Last check</th><th>Last error</th></tr>
+{{ range .Targets }}<tr>
+<td>{{ .Name }}</td>
+<td class="state {{ .State }}">{{ .State }}</td>
+<td>{{ .ConsecutiveFailures }}</td>
+<td>{{ if .LastCheck }}{{ .LastCheck.Format "2006-01-02 15:04:05 MST" }}{{ else }}never{{ end }}</td>
+<td>{{ .LastError }}</td>
+</tr>
+{{ end }}</table>
+</body>
+</html>
+`))
+
+type statusPageTarget struct {
+	healthResponse
+	Name  string
+	State string
+}
+
+// handleStatusPage renders a human readable overview of the state of all
+// targets from the same status as the health endpoint
+func handleStatusPage(res http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(res, r)
+		return
+	}
+
+	var rows []statusPageTarget
+	for _, t := range targets {
+		h := t.status.healthResponse()
+		rows = append(rows, statusPageTarget{healthResponse: h, Name: t.name(), State: h.checkState().String()})
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPageTemplate.Execute(res, struct {
+		Version string
+		Uptime  time.Duration
+		Targets []statusPageTarget
+	}{version, time.Since(startTime).Round(time.Second), rows}); err != nil {
+		logger.Errorf("Unable to render status page: %s", err)
+	}
+}
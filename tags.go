@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// tags are attached to all notifications and metrics, they are parsed
+// from the tag flag
+var tags map[string]string
+
+var tagKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseTags parses a list of tags in format key=value. The keys need to be
+// valid metric label names not used by any metric.
+func parseTags(list []string) (map[string]string, error) {
+	reserved := metricLabelNames()
+
+	t := map[string]string{}
+	for _, tag := range nonEmpty(list) {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Tag %q is not in format key=value", tag)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		switch {
+		case !tagKeyPattern.MatchString(key):
+			return nil, fmt.Errorf("Tag key %q may only contain letters, digits and underscores", key)
+		case reserved[key]:
+			return nil, fmt.Errorf("Tag key %q is already used as metric label", key)
+		}
+
+		t[key] = strings.TrimSpace(parts[1])
+	}
+	return t, nil
+}
+
+// sortedTagKeys returns the keys of the tags in a stable order
+func sortedTagKeys() []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// deliveryState describes whether the last transition queued for an
+// alert was delivered to the notifiers
+type deliveryState uint
+
+const (
+	deliveryDone deliveryState = iota
+	deliveryPending
+	deliveryFailed
+)
+
+// deliveryTracker records which transitions of an alert were delivered to
+// which notifier
+type deliveryTracker struct {
+	// notifierStates is only accessed by the notification worker
+	notifierStates map[string]alarmState
+
+	deliveryState deliveryState
+	deliveryLock  sync.Mutex
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{notifierStates: map[string]alarmState{}}
+}
+
+func (d *deliveryTracker) delivery() deliveryState {
+	d.deliveryLock.Lock()
+	defer d.deliveryLock.Unlock()
+	return d.deliveryState
+}
+
+func (d *deliveryTracker) setDelivery(s deliveryState) {
+	d.deliveryLock.Lock()
+	defer d.deliveryLock.Unlock()
+	d.deliveryState = s
+}
+
+// checkTarget holds the alerting state of a single monitored Vault key on
+// a single Vault node checked in a single check mode
+type checkTarget struct {
+	address string
+	mode    string
+	key     string
+
+	alertCounter int
+	// thresholdCounter counts the same failures as alertCounter but is
+	// not reset by successes during an active alert, only by the resolve,
+	// so notifiers with a higher threshold are triggered while the alert
+	// is already active. notifiedThreshold is
+	// the counter at the time of the last queued trigger.
+	thresholdCounter  int
+	notifiedThreshold int
+	// failureStreak counts consecutive failures and, unlike alertCounter,
+	// is not reset when an alert is sent
+	failureStreak int
+	failingSince  time.Time
+	escalated     bool
+	// incidentStart is the start of the failure streak of the active
+	// alert, the latency of the checks since then is sent with the resolve
+	incidentStart time.Time
+	// successCounter counts consecutive successes and gates the resolve
+	// the same way alertCounter gates the trigger
+	successCounter int
+	slowCounter    int
+	alertActive    alarmState
+	stateSince     time.Time
+	lastError      error
+	lastErrorClass string
+	lastSuccess    time.Time
+	// sealInfo is queried after failed checks and nil otherwise
+	sealInfo *sealInfo
+	// connectionFailures counts consecutive connection-level failures and
+	// opens the circuit breaker when reaching circuit-breaker
+	connectionFailures int
+	// trace numbers the requests of the last check, nil without
+	// request-id-header
+	trace *requestTrace
+
+	*deliveryTracker
+	status *checkStatus
+}
+
+func newCheckTarget(address, mode, key string) *checkTarget {
+	t := &checkTarget{
+		address:         address,
+		mode:            mode,
+		key:             key,
+		stateSince:      time.Now(),
+		deliveryTracker: newDeliveryTracker(),
+		status:          &checkStatus{},
+	}
+	t.publishAlertState()
+	return t
+}
+
+// incidentLatency summarizes the latency of the checks since the start of
+// the active incident or returns nil without an incident
+func (t *checkTarget) incidentLatency() *latencySummary {
+	if t.incidentStart.IsZero() {
+		return nil
+	}
+	return t.status.LatencySince(t.incidentStart)
+}
+
+// circuitOpen reports whether the circuit breaker skips the full test
+func (t *checkTarget) circuitOpen() bool {
+	return cfg.CircuitBreaker > 0 && t.connectionFailures >= cfg.CircuitBreaker
+}
+
+// configuredTargets creates a target for every key of every check mode on
+// every Vault node
+func configuredTargets() []*checkTarget {
+	var t []*checkTarget
+
+	for _, address := range vaultAddresses() {
+		for _, mode := range checkModes() {
+			for _, key := range vaultKeys(mode) {
+				t = append(t, newCheckTarget(address, mode, key))
+			}
+		}
+	}
+
+	return t
+}
+
+// checkModes returns the configured check modes
+func checkModes() []string {
+	return nonEmpty(cfg.CheckModes)
+}
+
+// keysPerNode returns the number of keys checked on every Vault node
+// summed up over all check modes
+func keysPerNode() int {
+	n := 0
+	for _, mode := range checkModes() {
+		n += len(vaultKeys(mode))
+	}
+	return n
+}
+
+// vaultAddresses returns the nodes from the vault-addresses list, falling
+// back to the single vault-address
+func vaultAddresses() []string {
+	addresses := nonEmpty(cfg.VaultAddresses)
+	if len(addresses) == 0 {
+		return []string{cfg.VaultAddress}
+	}
+	return addresses
+}
+
+// vaultKeys returns the keys checked in the given mode: the keys from the
+// vault-keys list, falling back to the single vault-key. In transit and
+// database mode the transit-key or the database-role is the only key, in
+// wrapping mode the wrap endpoint.
+func vaultKeys(mode string) []string {
+	switch mode {
+	case checkModeTransit:
+		return []string{cfg.TransitKey}
+	case checkModeDatabase:
+		return []string{cfg.DatabaseRole}
+	case checkModeWrapping:
+		return []string{wrappingKey}
+	}
+
+	keys := nonEmpty(cfg.VaultKeys)
+	if len(keys) == 0 {
+		return []string{cfg.VaultKey}
+	}
+	return keys
+}
+
+// nonEmpty trims the list entries and drops empty ones
+func nonEmpty(list []string) []string {
+	var out []string
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// logFields returns the fields identifying the target in a log line
+func (t *checkTarget) logFields() logFields {
+	return logFields{
+		"vault_address": t.address,
+		"vault_key":     t.key,
+		"check_mode":    t.mode,
+	}
+}
+
+// name identifies the target in logs and the health endpoint. The address
+// is only included when multiple Vault nodes are monitored, the mode only
+// with multiple check modes.
+func (t *checkTarget) name() string {
+	name := t.key
+	if len(checkModes()) > 1 {
+		name = t.mode + " " + name
+	}
+	if len(vaultAddresses()) > 1 {
+		name = t.address + " " + name
+	}
+	return name
+}
+
+// publishAlertState mirrors the current alert counter and state into the
+// metrics and the status exposed through the health endpoint
+func (t *checkTarget) publishAlertState() {
+	metricConsecutiveFailures.Set(float64(t.alertCounter), t.address, t.key, t.mode)
+	metricAlertActive.Set(float64(t.alertActive), t.address, t.key, t.mode)
+	t.status.SetAlertState(t.alertCounter, t.alertActive)
+}
+
+// alertAction is the notification to send after a check
+type alertAction uint
+
+const (
+	actionNone alertAction = iota
+	actionTrigger
+	actionResolve
+)
+
+// alertDecisionInput is the state of a target after recording the result
+// of a check
+type alertDecisionInput struct {
+	CheckFailed    bool
+	State          alarmState
+	DeliveryFailed bool
+	AlertCounter   int
+	SuccessCounter int
+	// ThresholdCounter and PendingThreshold decide whether the active
+	// alert needs to be sent to notifiers having a higher threshold,
+	// PendingThreshold is zero if all notifiers were triggered
+	ThresholdCounter int
+	PendingThreshold int
+}
+
+// decideAlertAction decides which notification to send after a check.
+// Triggers are sent when the alert counter reached the alert threshold,
+// resolves when the success counter reached the resolve threshold. A
+// transition into the current state is only sent again if its delivery
+// failed, which also retries a failed trigger with every failing check
+// instead of waiting for the threshold to be reached once more, or if the
+// threshold of a notifier not yet triggered was reached.
+func decideAlertAction(in alertDecisionInput, alertThreshold, resolveThreshold int) alertAction {
+	if in.CheckFailed {
+		if in.State == stateFailed {
+			if in.DeliveryFailed || (in.PendingThreshold > 0 && in.ThresholdCounter >= in.PendingThreshold) {
+				return actionTrigger
+			}
+			return actionNone
+		}
+
+		if in.AlertCounter >= alertThreshold {
+			return actionTrigger
+		}
+		return actionNone
+	}
+
+	if in.SuccessCounter < resolveThreshold {
+		return actionNone
+	}
+
+	if in.State == stateOK && !in.DeliveryFailed {
+		return actionNone
+	}
+	return actionResolve
+}
+
+func (t *checkTarget) alertDecisionInput(checkFailed bool) alertDecisionInput {
+	return alertDecisionInput{
+		CheckFailed:    checkFailed,
+		State:          t.alertActive,
+		DeliveryFailed: t.delivery() == deliveryFailed,
+		AlertCounter:   t.alertCounter,
+		SuccessCounter: t.successCounter,
+
+		ThresholdCounter: t.thresholdCounter,
+		PendingThreshold: nextNotifierThreshold(t.notifiedThreshold),
+	}
+}
+
+// pendingNotifiers reports whether the active alert still needs to be sent
+// to notifiers whose threshold was reached since the last trigger
+func (t *checkTarget) pendingNotifiers() bool {
+	next := nextNotifierThreshold(t.notifiedThreshold)
+	return t.alertActive == stateFailed && next > 0 && t.thresholdCounter >= next
+}
+
+// transition switches the alert state, logs a structured transition event
+// and publishes the time of the transition
+func (t *checkTarget) transition(state alarmState) {
+	now := time.Now()
+
+	fields := t.logFields()
+	fields["from_state"] = t.alertActive.String()
+	fields["to_state"] = state.String()
+	fields["previous_state_duration"] = now.Sub(t.stateSince).String()
+	if state == stateFailed && t.lastError != nil {
+		fields["error"] = t.lastError
+	}
+	logger.WithFields(fields).Noticef("Alert state changed from %s to %s", t.alertActive, state)
+
+	t.alertActive = state
+	t.stateSince = now
+	t.escalated = false
+	metricLastTransition.Set(float64(now.Unix()), t.address, t.key, t.mode)
+}
+
+// publishErrorClass exposes the class of the error of the last check,
+// removing the previous class. Passing an empty class clears the metric.
+func (t *checkTarget) publishErrorClass(class string) {
+	if t.lastErrorClass != "" && t.lastErrorClass != class {
+		metricLastError.Delete(t.address, t.key, t.mode, t.lastErrorClass)
+	}
+	if class != "" {
+		metricLastError.Set(1, t.address, t.key, t.mode, class)
+	}
+	t.lastErrorClass = class
+}
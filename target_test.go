@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDecideAlertAction(t *testing.T) {
+	const (
+		alertThreshold   = 3
+		resolveThreshold = 2
+	)
+
+	for _, tc := range []struct {
+		name string
+		in   alertDecisionInput
+		want alertAction
+	}{
+		{
+			name: "failure below the alert threshold",
+			in:   alertDecisionInput{CheckFailed: true, State: stateOK, AlertCounter: alertThreshold - 1},
+			want: actionNone,
+		},
+		{
+			name: "failure reaching the alert threshold",
+			in:   alertDecisionInput{CheckFailed: true, State: stateOK, AlertCounter: alertThreshold},
+			want: actionTrigger,
+		},
+		{
+			name: "failure reaching the alert threshold from unknown state",
+			in:   alertDecisionInput{CheckFailed: true, State: stateUnknown, AlertCounter: alertThreshold},
+			want: actionTrigger,
+		},
+		{
+			name: "failure of an already triggered alert",
+			in:   alertDecisionInput{CheckFailed: true, State: stateFailed, AlertCounter: alertThreshold + 1},
+			want: actionNone,
+		},
+		{
+			name: "success below the resolve threshold",
+			in:   alertDecisionInput{State: stateFailed, SuccessCounter: resolveThreshold - 1},
+			want: actionNone,
+		},
+		{
+			name: "success reaching the resolve threshold",
+			in:   alertDecisionInput{State: stateFailed, SuccessCounter: resolveThreshold},
+			want: actionResolve,
+		},
+		{
+			name: "success reaching the resolve threshold from unknown state",
+			in:   alertDecisionInput{State: stateUnknown, SuccessCounter: resolveThreshold},
+			want: actionResolve,
+		},
+		{
+			name: "success of a resolved alert",
+			in:   alertDecisionInput{State: stateOK, SuccessCounter: resolveThreshold + 1},
+			want: actionNone,
+		},
+		{
+			name: "failed trigger is retried with the next failure",
+			in:   alertDecisionInput{CheckFailed: true, State: stateFailed, DeliveryFailed: true, AlertCounter: 1},
+			want: actionTrigger,
+		},
+		{
+			name: "failed resolve is retried with the next success",
+			in:   alertDecisionInput{State: stateOK, DeliveryFailed: true, SuccessCounter: resolveThreshold},
+			want: actionResolve,
+		},
+		{
+			name: "failed resolve is not retried below the resolve threshold",
+			in:   alertDecisionInput{State: stateOK, DeliveryFailed: true, SuccessCounter: resolveThreshold - 1},
+			want: actionNone,
+		},
+		{
+			name: "pending notifier threshold not yet reached",
+			in:   alertDecisionInput{CheckFailed: true, State: stateFailed, ThresholdCounter: 4, PendingThreshold: 5},
+			want: actionNone,
+		},
+		{
+			name: "pending notifier threshold reached",
+			in:   alertDecisionInput{CheckFailed: true, State: stateFailed, ThresholdCounter: 5, PendingThreshold: 5},
+			want: actionTrigger,
+		},
+		{
+			name: "all notifiers triggered",
+			in:   alertDecisionInput{CheckFailed: true, State: stateFailed, ThresholdCounter: 10},
+			want: actionNone,
+		},
+	} {
+		if got := decideAlertAction(tc.in, alertThreshold, resolveThreshold); got != tc.want {
+			t.Errorf("%s: got action %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestFlappingChecks records alternating results and verifies the
+// failures between successes never add up to a trigger
+func TestFlappingChecks(t *testing.T) {
+	defer func(alert, resolve int) {
+		cfg.AlertThreshold, cfg.ResolveThreshold = alert, resolve
+	}(cfg.AlertThreshold, cfg.ResolveThreshold)
+	cfg.AlertThreshold, cfg.ResolveThreshold = 2, 1
+
+	// A connection error skips querying the seal status
+	failure := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	for _, tc := range []struct {
+		name    string
+		results []bool // true for a failed check
+	}{
+		{"alternating", []bool{true, false, true, false, true, false, true, false}},
+		{"starting with a success", []bool{false, true, false, true, false, true}},
+		{"single failures between successes", []bool{true, false, false, true, false, false, true}},
+	} {
+		target := newCheckTarget("http://127.0.0.1:8200", checkModeKV, tc.name)
+		for i, failed := range tc.results {
+			run := checkRun{start: time.Now()}
+			if failed {
+				run.err = failure
+			}
+			recordCheck(target, run)
+
+			if target.alertActive == stateFailed {
+				t.Fatalf("%s: triggered by check %d although the failures were not consecutive", tc.name, i+1)
+			}
+		}
+		drainNotifyQueue()
+	}
+}
+
+func drainNotifyQueue() {
+	for {
+		select {
+		case <-notifyQueue:
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+var (
+	// tokenWarningState is the state of the token TTL warning, it is only
+	// accessed by the check loop
+	tokenWarningState   alarmState
+	tokenWarningTracker = newDeliveryTracker()
+)
+
+// checkTokenTTL looks up the remaining TTL of the static token and sends a
+// warning, distinct from the outage alert, while it is below the
+// token-ttl-warning. The warning is resolved once the TTL is sufficient
+// again, for example after the token was rotated.
+func checkTokenTTL() {
+	address := vaultAddresses()[0]
+
+	client, err := getVaultClient(address)
+	if err != nil {
+		logger.Warnf("Token lookup for TTL warning failed: %s", err)
+		return
+	}
+
+	secret, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		logger.Warnf("Token lookup for TTL warning failed: %s", err)
+		return
+	}
+
+	// Tokens without TTL never expire and are reported as zero
+	ttl, _ := tokenTTL(secret)
+
+	state := stateOK
+	if ttl > 0 && ttl < cfg.TokenTTLWarning {
+		state = stateFailed
+	}
+
+	if state == tokenWarningState && tokenWarningTracker.delivery() != deliveryFailed {
+		return
+	}
+
+	if state == stateOK && tokenWarningState == stateUnknown {
+		// Nothing to resolve as no warning was sent yet
+		tokenWarningState = stateOK
+		return
+	}
+
+	n := notification{
+		tracker: tokenWarningTracker,
+		state:   state,
+		info: alertInfo{
+			Kind:         alertKindTokenTTL,
+			VaultAddress: address,
+			IncidentKey:  generateIncidentKey(address, "", "") + "-token-ttl",
+			TokenTTL:     ttl,
+		},
+	}
+
+	if err := queueNotification(n); err != nil {
+		logger.Errorf("Was not able to send token TTL warning: %s", err)
+		return
+	}
+
+	if state == stateFailed {
+		logger.Warnf("Token expires in %s (warning threshold %s)", ttl, cfg.TokenTTLWarning)
+	}
+	tokenWarningState = state
+}
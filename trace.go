@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/hashicorp/vault/api"
+	uuid "github.com/satori/go.uuid"
+)
+
+// requestTrace numbers the requests of a single check. Every request is
+// sent with the ID of the check suffixed by its number in the
+// request-id-header to find the requests of a failed check in the Vault
+// audit log.
+type requestTrace struct {
+	checkID string
+
+	requests int
+	lastID   string
+	lock     sync.Mutex
+}
+
+func newRequestTrace() *requestTrace {
+	return &requestTrace{checkID: uuid.NewV4().String()}
+}
+
+// next returns the ID for the next request of the check
+func (r *requestTrace) next() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.requests++
+	r.lastID = fmt.Sprintf("%s-%d", r.checkID, r.requests)
+	return r.lastID
+}
+
+// logFields returns the check ID and the ID of the last request, which
+// for a failed check is the one having failed, to be attached to a log
+// line. Without a trace no fields are returned.
+func (r *requestTrace) logFields() logFields {
+	if r == nil {
+		return logFields{}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f := logFields{"check_id": r.checkID}
+	if r.lastID != "" {
+		f["last_request_id"] = r.lastID
+	}
+	return f
+}
+
+// requestIDTransport sets the request-id-header on every request
+type requestIDTransport struct {
+	trace *requestTrace
+	next  http.RoundTripper
+}
+
+func (t requestIDTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	id := t.trace.next()
+	r = r.Clone(r.Context())
+	r.Header.Set(cfg.RequestIDHeader, id)
+	logger.Debugf("Sending %s %s with request ID %s", r.Method, r.URL.Path, id)
+	return t.next.RoundTrip(r)
+}
+
+// contextTransport attaches the context of the check to every request to
+// cancel them together with the check
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(r.WithContext(t.ctx))
+}
+
+// checkClient returns a client for the node at the given address whose
+// requests are cancelled with the context and, if a trace is given, sent
+// with IDs of the trace. It shares the connections and the token of the
+// given client obtained through getVaultClient.
+func checkClient(ctx context.Context, address string, client *api.Client, trace *requestTrace) (*api.Client, error) {
+	vaultClientLock.Lock()
+	config, ok := vaultConfigs[address]
+	vaultClientLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("No Vault client for %s", address)
+	}
+
+	httpClient := *config.HttpClient
+	httpClient.Transport = contextTransport{ctx: ctx, next: config.HttpClient.Transport}
+	if trace != nil {
+		httpClient.Transport = requestIDTransport{trace: trace, next: httpClient.Transport}
+	}
+
+	traced, err := api.NewClient(&api.Config{Address: config.Address, HttpClient: &httpClient})
+	if err != nil {
+		return nil, err
+	}
+	traced.SetToken(client.Token())
+	return traced, nil
+}
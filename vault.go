@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rootcerts "github.com/hashicorp/go-rootcerts"
+	"github.com/hashicorp/vault/api"
+)
+
+var (
+	vaultClients    = map[string]*api.Client{}
+	vaultClientLock sync.Mutex
+	// vaultConfigs are the configs the vaultClients were created with
+	vaultConfigs = map[string]*api.Config{}
+
+	// vaultToken is the token obtained by a login and is kept when the
+	// client gets recreated
+	vaultToken          string
+	vaultTokenRefreshAt time.Time
+
+	// vaultHeaders are sent with every request to Vault
+	vaultHeaders map[string]string
+)
+
+// getVaultClient returns a client for the node at the given address
+// sharing the connections of its shared client, which is created on first
+// use and ensured to carry a valid token. The token is shared between the
+// clients of all nodes.
+func getVaultClient(address string) (*api.Client, error) {
+	vaultClientLock.Lock()
+	defer vaultClientLock.Unlock()
+
+	client, ok := vaultClients[address]
+	if !ok {
+		config, err := vaultConfig(address)
+		if err != nil {
+			return nil, err
+		}
+
+		if client, err = api.NewClient(config); err != nil {
+			return nil, err
+		}
+
+		client.SetToken(vaultToken)
+		vaultClients[address] = client
+		vaultConfigs[address] = config
+	}
+
+	if !usesVaultLogin() {
+		// Static tokens are re-read on every use to pick up rotated tokens
+		token, err := staticVaultToken()
+		if err != nil {
+			return nil, err
+		}
+		if client.Token() != token {
+			client.SetToken(token)
+		}
+		return clientCopy(address, client)
+	}
+
+	if vaultTokenNeedsRefresh() {
+		if err := vaultLogin(client); err != nil {
+			return nil, fmt.Errorf("Could not log in to Vault: %s", err)
+		}
+	}
+
+	if client.Token() != vaultToken {
+		// The token was obtained through the client of another node
+		client.SetToken(vaultToken)
+	}
+
+	return clientCopy(address, client)
+}
+
+// clientCopy returns a client using the config of the shared client of the
+// node with a copy of its token. The token of the shared client is replaced
+// on rotation or login while checks run in parallel and therefore only
+// accessed with the vaultClientLock held.
+func clientCopy(address string, client *api.Client) (*api.Client, error) {
+	c, err := api.NewClient(vaultConfigs[address])
+	if err != nil {
+		return nil, err
+	}
+	c.SetToken(client.Token())
+	return c, nil
+}
+
+// staticVaultToken returns the token read from vault-token-file if set
+// or the vault-token otherwise
+func staticVaultToken() (string, error) {
+	if cfg.VaultTokenFile == "" {
+		return cfg.VaultToken, nil
+	}
+
+	raw, err := ioutil.ReadFile(cfg.VaultTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("Could not read token file: %s", err)
+	}
+
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		return "", errors.New("Token file is empty")
+	}
+
+	return token, nil
+}
+
+// vaultConfig creates the client configuration for the node at the given
+// address including the TLS settings. Addresses with the unix:// scheme
+// are dialed through the Unix domain socket at the path of the address,
+// for example the listener of a local Vault Agent.
+func vaultConfig(address string) (*api.Config, error) {
+	config := api.DefaultConfig()
+	config.Address = address
+	config.MaxRetries = 0
+	config.HttpClient.Timeout = cfg.OperationTimeout
+
+	transport := config.HttpClient.Transport.(*http.Transport)
+	tlsConfig := transport.TLSClientConfig
+
+	if strings.HasPrefix(address, "unix://") {
+		socket := strings.TrimPrefix(address, "unix://")
+		// The host is not used for dialing, the client only requires a
+		// valid HTTP address to build the request URLs
+		config.Address = "http://localhost"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	if err := rootcerts.ConfigureTLS(tlsConfig, &rootcerts.Config{CAFile: cfg.VaultCACert}); err != nil {
+		return nil, fmt.Errorf("Could not load CA certificate: %s", err)
+	}
+
+	if cfg.VaultClientCert != "" && cfg.VaultClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.VaultClientCert, cfg.VaultClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	tlsConfig.InsecureSkipVerify = cfg.VaultTLSSkipVerify
+
+	headers := http.Header{}
+	headers.Set("User-Agent", userAgent())
+	for k, v := range vaultHeaders {
+		headers.Set(k, v)
+	}
+	if cfg.VaultNamespace != "" {
+		headers.Set("X-Vault-Namespace", cfg.VaultNamespace)
+	}
+
+	config.HttpClient.Transport = headerTransport{
+		headers: headers,
+		next:    config.HttpClient.Transport,
+	}
+
+	return config, nil
+}
+
+// headerTransport adds headers to every request sent to Vault as the
+// vendored client has no support for namespaces, custom headers or the
+// user agent
+type headerTransport struct {
+	headers http.Header
+	next    http.RoundTripper
+}
+
+func (h headerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	for k, v := range h.headers {
+		r.Header[k] = v
+	}
+	return h.next.RoundTrip(r)
+}
+
+// resetVaultClient drops the shared Vault client of the node so it gets
+// recreated on the next call to getVaultClient
+func resetVaultClient(address string) {
+	vaultClientLock.Lock()
+	defer vaultClientLock.Unlock()
+
+	delete(vaultClients, address)
+	delete(vaultConfigs, address)
+}
+
+const (
+	authMethodToken      = "token"
+	authMethodAppRole    = "approle"
+	authMethodKubernetes = "kubernetes"
+	authMethodCert       = "cert"
+)
+
+// vaultAuthMethod returns the configured auth method, defaulting to AppRole
+// if a role-id is given and to a static token otherwise
+func vaultAuthMethod() string {
+	switch {
+	case cfg.VaultAuth != "":
+		return cfg.VaultAuth
+	case cfg.VaultRoleID != "":
+		return authMethodAppRole
+	default:
+		return authMethodToken
+	}
+}
+
+// usesVaultLogin reports whether the token is obtained through an auth
+// method instead of being passed in statically
+func usesVaultLogin() bool {
+	return vaultAuthMethod() != authMethodToken
+}
+
+// vaultTokenNeedsRefresh reports whether there is no token yet or the
+// obtained token is near its expiry. Tokens without TTL are never refreshed.
+func vaultTokenNeedsRefresh() bool {
+	if vaultToken == "" {
+		return true
+	}
+	return !vaultTokenRefreshAt.IsZero() && time.Now().After(vaultTokenRefreshAt)
+}
+
+// vaultLogin logs in using the configured auth method, sets the obtained
+// token on the client and schedules the next login at two thirds of the
+// lease
+func vaultLogin(client *api.Client) error {
+	path, data, err := vaultLoginRequest()
+	if err != nil {
+		return err
+	}
+
+	client.ClearToken()
+
+	secret, err := client.Logical().Write(path, data)
+	if err != nil {
+		return err
+	}
+
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return errors.New("Login response did not contain a token")
+	}
+
+	vaultToken = secret.Auth.ClientToken
+	client.SetToken(vaultToken)
+
+	lease := time.Duration(secret.Auth.LeaseDuration) * time.Second
+	vaultTokenRefreshAt = time.Time{}
+	if lease > 0 {
+		vaultTokenRefreshAt = time.Now().Add(lease * 2 / 3)
+	}
+
+	logger.Debugf("Logged in to Vault using %s auth, token lease is %s", vaultAuthMethod(), lease)
+
+	return nil
+}
+
+// vaultLoginRequest returns the path and body of the login request for
+// the configured auth method
+func vaultLoginRequest() (string, map[string]interface{}, error) {
+	switch vaultAuthMethod() {
+	case authMethodKubernetes:
+		// The JWT is read on every login as Kubernetes rotates projected
+		// service account tokens
+		jwt, err := ioutil.ReadFile(cfg.VaultK8sJWT)
+		if err != nil {
+			return "", nil, fmt.Errorf("Could not read service account token: %s", err)
+		}
+
+		return "auth/kubernetes/login", map[string]interface{}{
+			"role": cfg.VaultK8sRole,
+			"jwt":  strings.TrimSpace(string(jwt)),
+		}, nil
+
+	case authMethodCert:
+		// The client certificate is presented through the TLS config of
+		// the client, the role is optional
+		data := map[string]interface{}{}
+		if cfg.VaultCertRole != "" {
+			data["name"] = cfg.VaultCertRole
+		}
+		return "auth/cert/login", data, nil
+
+	default:
+		return "auth/approle/login", map[string]interface{}{
+			"role_id":   cfg.VaultRoleID,
+			"secret_id": cfg.VaultSecretID,
+		}, nil
+	}
+}
+
+// startTokenRenewal looks up the static token and, if it is renewable and
+// has a TTL, keeps renewing it in the background. Tokens obtained through
+// a login are refreshed by logging in again instead. As the token is valid
+// cluster-wide it is renewed through the first Vault node only.
+func startTokenRenewal() {
+	if usesVaultLogin() {
+		return
+	}
+
+	client, err := getVaultClient(vaultAddresses()[0])
+	if err != nil {
+		logger.Errorf("Token lookup failed: %s", err)
+		return
+	}
+
+	secret, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		logger.Errorf("Token lookup failed: %s", err)
+		return
+	}
+
+	ttl, renewable := tokenTTL(secret)
+	if !renewable || ttl == 0 {
+		logger.Debugf("Token is not renewable or has no TTL, not renewing")
+		return
+	}
+
+	go renewToken(ttl)
+}
+
+// renewToken renews the token at about two thirds of its lease duration
+func renewToken(ttl time.Duration) {
+	wait := ttl * 2 / 3
+
+	for {
+		time.Sleep(wait)
+
+		client, err := getVaultClient(vaultAddresses()[0])
+		if err != nil {
+			logger.Errorf("Token renewal failed, retrying in %s: %s", cfg.CheckInterval, err)
+			wait = cfg.CheckInterval
+			continue
+		}
+
+		secret, err := client.Auth().Token().RenewSelf(0)
+		if err != nil || secret == nil || secret.Auth == nil {
+			logger.Errorf("Token renewal failed, retrying in %s: %v", cfg.CheckInterval, err)
+			wait = cfg.CheckInterval
+			continue
+		}
+
+		lease := time.Duration(secret.Auth.LeaseDuration) * time.Second
+		if lease == 0 {
+			logger.Warnf("Token renewal returned no lease, stopping renewal")
+			return
+		}
+
+		logger.Debugf("Renewed token, lease is now %s", lease)
+		wait = lease * 2 / 3
+	}
+}
+
+// tokenTTL extracts the TTL and renewability from a token lookup response
+func tokenTTL(secret *api.Secret) (time.Duration, bool) {
+	if secret == nil || secret.Data == nil {
+		return 0, false
+	}
+
+	renewable, _ := secret.Data["renewable"].(bool)
+
+	var ttl int64
+	switch v := secret.Data["ttl"].(type) {
+	case json.Number:
+		ttl, _ = v.Int64()
+	case float64:
+		ttl = int64(v)
+	}
+
+	return time.Duration(ttl) * time.Second, renewable
+}
+
+// isConnectionError checks whether the error occurred on the transport
+// level (DNS failures, refused connections, timeouts) instead of being an
+// error response of the Vault API
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var (
+		netErr net.Error
+		urlErr *url.Error
+	)
+	return errors.As(err, &netErr) || errors.As(err, &urlErr)
+}
+
+// vaultStatusPattern extracts the status code from the errors of the
+// vendored Vault client which does not expose it as a field
+var vaultStatusPattern = regexp.MustCompile(`Code: (\d{3})\.`)
+
+// vaultStatusCode returns the status code of a Vault API error response or
+// zero if the error is not an error response
+func vaultStatusCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	m := vaultStatusPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+
+	code, _ := strconv.Atoi(m[1])
+	return code
+}
+
+// ignoredStatusCodes are the status codes of ignore-status-codes
+var ignoredStatusCodes map[int]bool
+
+// parseStatusCodes parses a list of HTTP status codes ignoring empty
+// entries
+func parseStatusCodes(list []string) (map[int]bool, error) {
+	codes := map[int]bool{}
+	for _, entry := range nonEmpty(list) {
+		code, err := strconv.Atoi(entry)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("%q is not an HTTP status code", entry)
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+// sealInfo tells a sealed Vault apart from other outages in the context of
+// failed checks
+type sealInfo struct {
+	Sealed        bool
+	HAEnabled     bool
+	IsLeader      bool
+	LeaderAddress string
+}
+
+// logFields returns the seal status to be attached to a log line
+func (s sealInfo) logFields() logFields {
+	f := logFields{"sealed": s.Sealed}
+	if s.HAEnabled {
+		f["is_leader"] = s.IsLeader
+		f["leader_address"] = s.LeaderAddress
+	}
+	return f
+}
+
+// querySealInfo reads the seal status and HA leader of the node at the
+// given address, it returns nil if Vault is not reachable
+func querySealInfo(address string) *sealInfo {
+	client, err := getVaultClient(address)
+	if err != nil {
+		return nil
+	}
+
+	seal, err := client.Sys().SealStatus()
+	if err != nil {
+		logger.Debugf("Could not query seal status of %s: %s", address, err)
+		return nil
+	}
+
+	info := &sealInfo{Sealed: seal.Sealed}
+	if seal.Sealed {
+		// A sealed node is not able to answer the leader request
+		return info
+	}
+
+	leader, err := client.Sys().Leader()
+	if err != nil {
+		logger.Debugf("Could not query HA leader of %s: %s", address, err)
+		return info
+	}
+
+	info.HAEnabled = leader.HAEnabled
+	info.IsLeader = leader.IsSelf
+	info.LeaderAddress = leader.LeaderAddress
+	return info
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKV is a minimal KV v1 engine answering the requests of the kv check
+type fakeKV struct {
+	data map[string]json.RawMessage
+	lock sync.Mutex
+}
+
+func (f *fakeKV) ServeHTTP(res http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") == "" {
+		http.Error(res, `{"errors":["missing token"]}`, http.StatusForbidden)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(res, `{"errors":["invalid body"]}`, http.StatusBadRequest)
+			return
+		}
+		f.data[r.URL.Path] = body
+		res.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		delete(f.data, r.URL.Path)
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		body, ok := f.data[r.URL.Path]
+		if !ok {
+			http.Error(res, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(res).Encode(map[string]json.RawMessage{"data": body})
+	}
+}
+
+// TestConcurrentChecksWithTokenRotation checks two targets of the same
+// node in parallel while the token file is rotated, run with -race to
+// detect unsynchronized access to the token of the shared client
+func TestConcurrentChecksWithTokenRotation(t *testing.T) {
+	vault := httptest.NewServer(&fakeKV{data: map[string]json.RawMessage{}})
+	defer vault.Close()
+	defer resetVaultClient(vault.URL)
+
+	savedCfg, savedTargets := cfg, targets
+	defer func() { cfg, targets = savedCfg, savedTargets }()
+	drainNotifyQueue()
+	defer drainNotifyQueue()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	writeToken := func(token string) {
+		// Replaced atomically as an empty file is no valid token
+		tmp := tokenFile + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(token), 0o600); err != nil {
+			t.Errorf("writing token file: %s", err)
+			return
+		}
+		if err := os.Rename(tmp, tokenFile); err != nil {
+			t.Errorf("replacing token file: %s", err)
+		}
+	}
+	writeToken("token-0")
+
+	cfg.VaultToken = ""
+	cfg.VaultTokenFile = tokenFile
+	cfg.Concurrency = 2
+	cfg.OperationTimeout = 5 * time.Second
+	cfg.CheckTimeout = 0
+	cfg.Operations = []string{"write", "read", "delete"}
+	cfg.WriteIterations = 1
+	cfg.KVVersion = 1
+	cfg.TestField, cfg.TestFields = "value", 1
+	cfg.AlertThreshold, cfg.ResolveThreshold = 1, 1
+
+	targets = []*checkTarget{
+		newCheckTarget(vault.URL, checkModeKV, "secret/a"),
+		newCheckTarget(vault.URL, checkModeKV, "secret/b"),
+	}
+
+	done := make(chan struct{})
+	rotated := make(chan struct{})
+	go func() {
+		defer close(rotated)
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				writeToken(fmt.Sprintf("token-%d", i))
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		checkTargets(context.Background())
+		for _, target := range targets {
+			if target.lastError != nil {
+				t.Errorf("check %d of %s failed: %s", i+1, target.name(), target.lastError)
+			}
+		}
+	}
+	close(done)
+	<-rotated
+}